@@ -0,0 +1,96 @@
+// Package accesslog implements the proxy's access log: a record of every client connection written as a JSON object
+// per line when the connection has been closed.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Entry is the record of a single client connection.
+type Entry struct {
+	// Time is when the connection has been closed.
+	Time time.Time
+	// Frontend is the name of the frontend that accepted the connection.
+	Frontend string
+	// Client is the address of the client. On frontends accepting the PROXY protocol, it's the address from the header.
+	Client string
+	// Backend is the address of the backend the connection has been proxied to or, if connecting to all backends
+	// failed, of the last backend tried. It's empty if the connection has been rejected before choosing a backend.
+	Backend string
+	// Retries is the number of backends tried after connecting to the first one failed.
+	Retries int
+	// ConnectDuration is the time it took to connect to the backend.
+	ConnectDuration time.Duration
+	// Duration is the time the connection has been open.
+	Duration       time.Duration
+	BytesToBackend int64
+	BytesToClient  int64
+	// CloseReason tells why the connection has been closed: how the proxied connection ended or why it has been
+	// rejected.
+	CloseReason string
+}
+
+type jsonEntry struct {
+	Time            time.Time `json:"time"`
+	Frontend        string    `json:"frontend"`
+	Client          string    `json:"client"`
+	Backend         string    `json:"backend,omitempty"`
+	Retries         int       `json:"retries"`
+	ConnectSeconds  float64   `json:"connect_seconds"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesToBackend  int64     `json:"bytes_to_backend"`
+	BytesToClient   int64     `json:"bytes_to_client"`
+	CloseReason     string    `json:"close_reason"`
+}
+
+// MarshalJSON encodes the entry with snake_case keys and durations in seconds.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	//nolint:wrapcheck // encoding a struct of plain values can't fail.
+	return json.Marshal(jsonEntry{
+		Time:            e.Time,
+		Frontend:        e.Frontend,
+		Client:          e.Client,
+		Backend:         e.Backend,
+		Retries:         e.Retries,
+		ConnectSeconds:  e.ConnectDuration.Seconds(),
+		DurationSeconds: e.Duration.Seconds(),
+		BytesToBackend:  e.BytesToBackend,
+		BytesToClient:   e.BytesToClient,
+		CloseReason:     e.CloseReason,
+	})
+}
+
+// Logger writes entries to a writer, one JSON object per line. It is safe for concurrent use and a nil Logger discards
+// all entries.
+type Logger struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+// New creates a logger writing to w.
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Log writes an entry. Each entry is passed to the writer in a single call.
+func (l *Logger) Log(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed encoding access log entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		return fmt.Errorf("failed writing access log entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/accesslog"
+)
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := accesslog.New(&buf)
+	require.NoError(t, l.Log(accesslog.Entry{
+		Time:            time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Frontend:        "tcp/127.0.0.1:8080",
+		Client:          "127.0.0.1:50000",
+		Backend:         "127.0.0.1:9090",
+		Retries:         1,
+		ConnectDuration: 1500 * time.Microsecond,
+		Duration:        2 * time.Second,
+		BytesToBackend:  10,
+		BytesToClient:   20,
+		CloseReason:     "client_eof",
+	}))
+	require.NoError(t, l.Log(accesslog.Entry{Frontend: "tcp/127.0.0.1:8080", CloseReason: "denied"}))
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	require.Len(t, lines, 2)
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &entry))
+	require.Equal(t, map[string]any{
+		"time":             "2024-05-01T12:00:00Z",
+		"frontend":         "tcp/127.0.0.1:8080",
+		"client":           "127.0.0.1:50000",
+		"backend":          "127.0.0.1:9090",
+		"retries":          1.0,
+		"connect_seconds":  0.0015,
+		"duration_seconds": 2.0,
+		"bytes_to_backend": 10.0,
+		"bytes_to_client":  20.0,
+		"close_reason":     "client_eof",
+	}, entry)
+
+	require.NoError(t, (*accesslog.Logger)(nil).Log(accesslog.Entry{}))
+}
+
+func TestFileRotatesBySize(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := accesslog.OpenFile(path, 10, 2)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	for file, content := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		require.Equal(t, content, string(data), file)
+	}
+	require.NoFileExists(t, path+".3")
+}
+
+func TestFileKeepsWritingWhenRotationFails(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := accesslog.OpenFile(path, 10, 1)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+
+	// a non-empty directory in place of the backup can't be replaced by the file being rotated.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o750))
+
+	_, err = f.Write([]byte("first\n"))
+	require.NoError(t, err)
+	n, err := f.Write([]byte("second\n"))
+	require.ErrorContains(t, err, "failed rotating access log file")
+	require.Equal(t, len("second\n"), n)
+
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = f.Write([]byte("third\n"))
+	require.NoError(t, err, "rotating should have been retried")
+
+	for file, content := range map[string]string{path: "third\n", path + ".1": "first\nsecond\n"} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		require.Equal(t, content, string(data), file)
+	}
+}
+
+func TestFileReopenCreatesMovedFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := accesslog.OpenFile(path, 0, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+
+	_, err = f.Write([]byte("before\n"))
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(path, path+".old"))
+	require.NoError(t, f.Reopen())
+	_, err = f.Write([]byte("after\n"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "after\n", string(data))
+	data, err = os.ReadFile(path + ".old")
+	require.NoError(t, err)
+	require.Equal(t, "before\n", string(data))
+}
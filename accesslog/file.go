@@ -0,0 +1,149 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// defaultMaxBackups is the number of rotated files kept if none is configured.
+const defaultMaxBackups = 5
+
+// File is an [io.Writer] appending to a file. It is safe for concurrent use.
+//
+// If a maximum size is set, the file is rotated before a write would exceed it: the file is renamed by appending ".1"
+// to its name, previously rotated files are renamed from ".1" to ".2" and so on, dropping those beyond the maximum
+// number of backups, and a new file is created. Files can also be rotated by an external tool such as logrotate that
+// renames the file and calls [File.Reopen] afterwards.
+type File struct {
+	path       string
+	mux        sync.Mutex
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenFile opens the file at path for appending, creating it if necessary. maxSize is the size in bytes at which the
+// file is rotated, rotation is disabled if it is zero. maxBackups defaults to 5 if it is zero.
+func OpenFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	f := &File{path: path}
+	f.SetRotation(maxSize, maxBackups)
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetRotation changes the size at which the file is rotated and the number of rotated files kept, see [OpenFile].
+func (f *File) SetRotation(maxSize int64, maxBackups int) {
+	if maxBackups <= 0 {
+		maxBackups = defaultMaxBackups
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.maxSize, f.maxBackups = maxSize, maxBackups
+}
+
+// Write appends p to the file, rotating it first if p would exceed the maximum size. Data is never split across files.
+// If rotating fails, p is appended to the current file anyway and the error is returned; rotating is retried on the
+// next write.
+func (f *File) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.f == nil {
+		return 0, fs.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			if f.f == nil {
+				return 0, err
+			}
+			n, writeErr := f.write(p)
+			return n, errors.Join(err, writeErr)
+		}
+	}
+	return f.write(p)
+}
+
+func (f *File) write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed writing to %q: %w", f.path, err)
+	}
+	return n, nil
+}
+
+// Reopen closes the file and opens the file at its path again, creating a new one if it has been moved away.
+func (f *File) Reopen() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.closeFile(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file. Subsequent writes fail.
+func (f *File) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.closeFile()
+}
+
+func (f *File) open() error {
+	//nolint:gosec // the path is configured by the operator and access logs are meant to be read by log shippers.
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed opening access log file: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to stat %q: %w", f.path, err), file.Close())
+	}
+	f.f, f.size = file, fi.Size()
+	return nil
+}
+
+func (f *File) closeFile() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	if err != nil {
+		return fmt.Errorf("failed closing %q: %w", f.path, err)
+	}
+	return nil
+}
+
+// rotate moves the current file and all rotated files one position up and opens a new file. If moving the files
+// fails, the file at path is opened again so that writes continue to succeed.
+func (f *File) rotate() error {
+	if err := f.closeFile(); err != nil {
+		return errors.Join(err, f.open())
+	}
+	if err := f.renameFiles(); err != nil {
+		return errors.Join(err, f.open())
+	}
+	return f.open()
+}
+
+// renameFiles moves the current file and all rotated files one position up, dropping the oldest one.
+func (f *File) renameFiles() error {
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed rotating access log file: %w", err)
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed rotating access log file: %w", err)
+	}
+	return nil
+}
@@ -2,29 +2,128 @@
 package backend
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand/v2"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/makkes/l4proxy/metrics"
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+var (
+	// ErrStopped is returned by [Backend.HandleConn] when the backend has been stopped.
+	ErrStopped = errors.New("backend has been stopped")
+	// ErrMaintenance is returned by [Backend.HandleConn] when the backend is in [StateMaintenance].
+	ErrMaintenance = errors.New("backend is in maintenance")
+	// ErrConnectionLimit is returned by [Backend.HandleConn] when the backend is handling the maximum number of
+	// connections already. See [WithMaxConnections].
+	ErrConnectionLimit = errors.New("backend has reached its connection limit")
+)
+
+// State is the administrative state of a backend. It controls whether the backend is used for connections
+// independently of its health.
+type State string
+
+const (
+	// StateReady is the default state. The backend receives new connections as long as it is healthy.
+	StateReady State = "ready"
+	// StateDrain keeps the connections already proxied to the backend but doesn't route new connections to it.
+	StateDrain State = "drain"
+	// StateMaintenance closes all connections proxied to the backend and doesn't route new connections to it.
+	StateMaintenance State = "maintenance"
+)
+
+// ParseState parses the textual representation of a [State].
+func ParseState(s string) (State, error) {
+	switch st := State(s); st {
+	case StateReady, StateDrain, StateMaintenance:
+		return st, nil
+	default:
+		return "", fmt.Errorf("unknown backend state %q, expected one of %s, %s, %s", s, StateReady, StateDrain, StateMaintenance)
+	}
+}
+
+// CloseReason tells why a connection handled by [Backend.HandleConn] has been closed.
+type CloseReason string
+
+const (
+	// CloseClientEOF means that the client closed the connection first.
+	CloseClientEOF CloseReason = "client_eof"
+	// CloseBackendEOF means that the backend closed the connection first.
+	CloseBackendEOF CloseReason = "backend_eof"
+	// CloseIdleTimeout means that the connection has been idle, see [IdleTimeouts].
+	CloseIdleTimeout CloseReason = "idle_timeout"
+	// CloseMaxLifetime means that the deadline of the context passed to [Backend.HandleConn] has been exceeded.
+	CloseMaxLifetime CloseReason = "max_lifetime"
+	// CloseCanceled means that the context passed to [Backend.HandleConn] has been canceled or the backend closed the
+	// connection on its own, e.g. when entering [StateMaintenance].
+	CloseCanceled CloseReason = "canceled"
+	// CloseError means that reading from or writing to either side failed.
+	CloseError CloseReason = "error"
 )
 
-type proxyFunc func(log logr.Logger, to net.Conn, from net.Conn, quitChan <-chan struct{}, keepaliveChan chan<- struct{}) <-chan struct{}
+// ConnStats describes a connection handled by [Backend.HandleConn].
+type ConnStats struct {
+	// ConnectDuration is the time it took to connect to the backend, including sending the PROXY protocol header.
+	ConnectDuration time.Duration
+	BytesToBackend  int64
+	BytesToClient   int64
+	CloseReason     CloseReason
+}
+
+type proxyFunc func(log logr.Logger, to net.Conn, from net.Conn, idle *IdleTracker, written prometheus.Counter) <-chan error
 
 // Backend represents a single backend served by a [frontend.Frontend].
 type Backend struct {
-	Addr    string `json:"addr"`
-	Network string `json:"network"`
-	log     logr.Logger
-	LastErr error `json:"last_err"`
-	healthy *bool
-	stopCh  chan struct{}
-	proxy   proxyFunc
-	mux     sync.RWMutex
+	Addr          string             `json:"addr"`
+	Network       string             `json:"network"`
+	Weight        int                `json:"weight"`
+	ProxyProtocol proxyproto.Version `json:"proxy_protocol"`
+	ServerNames   []string           `json:"server_names,omitempty"`
+	log           logr.Logger
+	LastErr       error `json:"last_err"`
+	healthy       *bool
+	stopCh        chan struct{}
+	stopOnce      sync.Once
+	stopped       atomic.Bool
+	proxy         proxyFunc
+	activeConns   atomic.Int64
+	metrics       *metrics.Backend
+	checker       HealthChecker
+	checkTimeout  time.Duration
+	checkJitter   time.Duration
+	// rise and fall are the numbers of consecutive successful and failed health checks needed for changing the
+	// backend's health. successes and failures count them and are guarded by mux since failed connection attempts
+	// count as failed checks, too.
+	rise      int
+	fall      int
+	successes int
+	failures  int
+	// cancelChecks aborts a running health check when the backend is stopped.
+	cancelChecks     context.CancelFunc
+	outlierDetection *OutlierDetection
+	outlier          outlierState
+	connectTimeout   time.Duration
+	tlsConfig        *tls.Config
+	maxConns         int
+	state            State
+	// conns holds the cancel functions of the connections being handled so that they can be closed when the
+	// backend is put into maintenance.
+	conns map[*context.CancelFunc]struct{}
+	mux   sync.RWMutex
 }
 
 func isClosedConnErr(err error) bool {
@@ -39,48 +138,7 @@ func logConnErr(log logr.Logger, err error, closedAddr, errAddr, errMsg string)
 	}
 }
 
-func quitRequested(quitChan <-chan struct{}) bool {
-	select {
-	case <-quitChan:
-		return true
-	default:
-		return false
-	}
-}
-
-func proxy(log logr.Logger, to, from net.Conn, quitChan <-chan struct{}, keepaliveChan chan<- struct{}) <-chan struct{} {
-	closeChan := make(chan struct{})
-	log = log.WithName(fmt.Sprintf("%s->%s", from.RemoteAddr().String(), to.RemoteAddr().String()))
-	go func() {
-		defer close(closeChan)
-		buf := make([]byte, 1024)
-		for {
-			if quitRequested(quitChan) {
-				return
-			}
-			nRead, err := from.Read(buf)
-			if err != nil {
-				logConnErr(log, err, from.RemoteAddr().String(), from.RemoteAddr().String(), "error reading from conn")
-				return
-			}
-			log.V(5).Info("read complete", "bytes", nRead)
-
-			if quitRequested(quitChan) {
-				return
-			}
-			log.V(6).Info("writing to " + to.RemoteAddr().String())
-			n, err := to.Write(buf[0:nRead])
-			if err != nil {
-				logConnErr(log, err, from.RemoteAddr().String(), to.RemoteAddr().String(), "error writing to conn")
-				return
-			}
-			log.V(5).Info("write complete", "bytes", n)
-
-			keepaliveChan <- struct{}{}
-		}
-	}()
-	return closeChan
-}
+const defaultConnectTimeout = 5 * time.Second
 
 // Option represents a configuration option passed to [NewBackend].
 type Option func(b *Backend)
@@ -93,11 +151,17 @@ func NewBackend(network, addr string, log logr.Logger, opts ...Option) *Backend
 		Network: network,
 		log:     log,
 		proxy:   proxy,
+		checker: TCPCheck{},
+		state:   StateReady,
+		conns:   make(map[*context.CancelFunc]struct{}),
 	}
 
 	for _, opt := range opts {
 		opt(b)
 	}
+	if c, ok := b.checker.(proxyProtocolChecker); ok && b.ProxyProtocol != proxyproto.None {
+		b.checker = c.withProxyProtocol(b.ProxyProtocol)
+	}
 
 	return b
 }
@@ -109,6 +173,111 @@ func WithProxyFunc(f proxyFunc) Option {
 	}
 }
 
+// WithWeight sets the weight of the backend, used by weighted load-balancing strategies.
+func WithWeight(w int) Option {
+	return func(b *Backend) {
+		b.Weight = w
+	}
+}
+
+// WithProxyProtocol makes the backend send a PROXY protocol header of the given version at the start of each
+// connection, informing the backend application about the original client address. The built-in health checks send
+// a header, too, so that backend applications requiring one don't reject them.
+func WithProxyProtocol(v proxyproto.Version) Option {
+	return func(b *Backend) {
+		b.ProxyProtocol = v
+	}
+}
+
+// WithServerNames sets the TLS server names the backend serves. Names are either exact hostnames or wildcards like
+// "*.example.com". See [Backend.MatchServerName].
+func WithServerNames(names ...string) Option {
+	return func(b *Backend) {
+		b.ServerNames = names
+	}
+}
+
+// WithHealthChecker sets the health check for the backend. Defaults to a [TCPCheck] that only connects to the backend.
+func WithHealthChecker(hc HealthChecker) Option {
+	return func(b *Backend) {
+		b.checker = hc
+	}
+}
+
+// WithPreviousState makes the backend take over the health, the administrative state and the metrics of a backend it
+// replaces, e.g. because its configuration changed. The backend then keeps receiving connections without waiting for
+// its first health check, and the health thresholds apply to that check. The replaced backend must be stopped with
+// [Backend.StopReplaced] so that the metrics are kept.
+func WithPreviousState(prev *Backend) Option {
+	return func(b *Backend) {
+		prev.mux.RLock()
+		defer prev.mux.RUnlock()
+		if prev.healthy != nil {
+			b.healthy = new(*prev.healthy)
+		}
+		b.LastErr = prev.LastErr
+		b.state = prev.state
+		b.metrics = prev.metrics
+	}
+}
+
+// WithHealthThresholds sets the number of consecutive successful health checks needed for an unhealthy backend to
+// become healthy (rise) and the number of consecutive failed checks needed for a healthy backend to become unhealthy
+// (fall). Both default to 1. The first check always determines the backend's initial health.
+func WithHealthThresholds(rise, fall int) Option {
+	return func(b *Backend) {
+		b.rise = rise
+		b.fall = fall
+	}
+}
+
+// WithHealthCheckTimeout sets the time after which a health check is aborted and considered failed. Defaults to the
+// health check interval.
+func WithHealthCheckTimeout(t time.Duration) Option {
+	return func(b *Backend) {
+		b.checkTimeout = t
+	}
+}
+
+// WithHealthCheckJitter sets the maximum random delay added to the health check interval so that the checks of many
+// backends are spread out over time. Defaults to a tenth of the interval.
+func WithHealthCheckJitter(j time.Duration) Option {
+	return func(b *Backend) {
+		b.checkJitter = j
+	}
+}
+
+// WithConnectTimeout sets the maximum time for establishing a connection to the backend before giving up. Defaults to
+// 5 seconds.
+func WithConnectTimeout(t time.Duration) Option {
+	return func(b *Backend) {
+		b.connectTimeout = t
+	}
+}
+
+// WithTLS makes the backend connect to the backend application using TLS with the given configuration. If the
+// configuration doesn't set a ServerName, the host part of the backend's address is used. A PROXY protocol header is
+// sent before the TLS handshake.
+func WithTLS(cfg *tls.Config) Option {
+	return func(b *Backend) {
+		b.tlsConfig = cfg
+	}
+}
+
+// WithMaxConnections limits the number of connections proxied to the backend concurrently. Zero means no limit.
+func WithMaxConnections(n int) Option {
+	return func(b *Backend) {
+		b.maxConns = n
+	}
+}
+
+// WithMetrics makes the backend record its metrics in m.
+func WithMetrics(m *metrics.Backend) Option {
+	return func(b *Backend) {
+		b.metrics = m
+	}
+}
+
 // IsHealthy reports whether the last health check for this backend returned success or not.
 // The backend may become unhealthy between health checks so frontend should prepare for a
 // non-responsive backend even when IsHealthy reports success.
@@ -119,6 +288,77 @@ func (b *Backend) IsHealthy() bool {
 	return healthy
 }
 
+// LastError returns the error of the last failed health check or connection attempt or nil if the backend is
+// healthy.
+func (b *Backend) LastError() error {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.LastErr
+}
+
+// State returns the backend's administrative state.
+func (b *Backend) State() State {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.state
+}
+
+// SetState changes the backend's administrative state. Putting the backend into [StateMaintenance] closes all
+// connections currently proxied to it.
+func (b *Backend) SetState(s State) {
+	b.mux.Lock()
+	b.state = s
+	var cancels []context.CancelFunc
+	if s == StateMaintenance {
+		for cancel := range b.conns {
+			cancels = append(cancels, *cancel)
+		}
+	}
+	b.mux.Unlock()
+
+	b.log.V(2).Info("backend state changed", "backend", b.Addr, "state", s)
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+// ActiveConns returns the number of connections currently being handled by this backend.
+func (b *Backend) ActiveConns() int64 {
+	return b.activeConns.Load()
+}
+
+// IsFull reports whether the backend is handling the maximum number of connections. See [WithMaxConnections].
+func (b *Backend) IsFull() bool {
+	return b.maxConns > 0 && b.activeConns.Load() >= int64(b.maxConns)
+}
+
+// MatchServerName reports how specifically the backend's server names match the given TLS server name. It returns -1
+// if none of the names matches and 0 if the backend doesn't have any server names, i.e. it serves all names. Matches
+// return higher values the more specific the matching name is: exact names are more specific than wildcards and
+// longer wildcards more specific than shorter ones. A wildcard like "*.example.com" matches all subdomains of
+// example.com but not example.com itself. Names are compared case-insensitively.
+func (b *Backend) MatchServerName(serverName string) int {
+	if len(b.ServerNames) == 0 {
+		return 0
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	best := -1
+	for _, name := range b.ServerNames {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name == "" {
+			continue
+		}
+		if name == serverName {
+			return math.MaxInt
+		}
+		if suffix, ok := strings.CutPrefix(name, "*"); ok && strings.HasPrefix(suffix, ".") &&
+			strings.HasSuffix(serverName, suffix) && len(serverName) > len(suffix) {
+			best = max(best, len(suffix))
+		}
+	}
+	return best
+}
+
 // Start starts the health check for this backend. Frontend can use [Backend.IsHealthy] to include or exclude this
 // backend from serving traffic.
 func (b *Backend) Start(interval int) error {
@@ -126,16 +366,37 @@ func (b *Backend) Start(interval int) error {
 		return errors.New("interval must be > 0")
 	}
 	b.stopCh = make(chan struct{})
+	b.mux.RLock()
+	healthy := b.healthy
+	b.mux.RUnlock()
+	if healthy != nil {
+		b.metrics.SetHealthy(*healthy)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancelChecks = cancel
+
+	period := time.Duration(interval) * time.Second
+	timeout := b.checkTimeout
+	if timeout <= 0 {
+		timeout = period
+	}
+	jitter := b.checkJitter
+	if jitter <= 0 {
+		jitter = period / 10
+	}
+
 	go func() {
-		b.checkHealth()
-		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		b.checkHealth(ctx, timeout)
+		// the next check is scheduled after the previous one has finished so that checks never overlap.
+		timer := time.NewTimer(period + rand.N(jitter)) //nolint:gosec // jitter doesn't need a secure random number.
 		for {
 			select {
 			case <-b.stopCh:
-				ticker.Stop()
+				timer.Stop()
 				return
-			case <-ticker.C:
-				b.checkHealth()
+			case <-timer.C:
+				b.checkHealth(ctx, timeout)
+				timer.Reset(period + rand.N(jitter)) //nolint:gosec // see above.
 			}
 		}
 	}()
@@ -143,60 +404,202 @@ func (b *Backend) Start(interval int) error {
 	return nil
 }
 
-// Stop stops the health check and marks the backend as stopped.
-// TODO: It's still possible to call [Backend.HandleConn] after Stop has been called.
+// Stop stops the health check and marks the backend as stopped. Connections that are already being handled are not
+// affected but subsequent calls to [Backend.HandleConn] fail with [ErrStopped]. The backend's metrics are deleted.
 func (b *Backend) Stop() {
+	b.metrics.Delete()
+	b.stop()
+}
+
+// StopReplaced is like [Backend.Stop] but keeps the backend's metrics since they have been taken over by the backend
+// replacing it, see [WithPreviousState]. Connections still being handled keep recording their metrics.
+func (b *Backend) StopReplaced() {
+	b.stop()
+}
+
+func (b *Backend) stop() {
+	b.stopped.Store(true)
 	if b.stopCh == nil {
 		// not running
 		return
 	}
-	close(b.stopCh)
+	b.stopOnce.Do(func() {
+		b.cancelChecks()
+		close(b.stopCh)
+	})
 }
 
-// HandleConn starts proxying data between a client represented by the provided net.Conn and this backend.
-func (b *Backend) HandleConn(ctx context.Context, c net.Conn, keepaliveChan chan<- struct{}) error {
+// HandleConn starts proxying data between a client represented by the provided net.Conn and this backend. It returns
+// when the connection has been closed by both sides or ctx is done; c is closed in that case. When one side only closes
+// its writing side, this is propagated to the other side, which may still send data (half-close). An error is returned
+// if the connection couldn't be established, e.g. because dialing the backend failed. Nothing has been read from or
+// written to c in that case and c is left open so that the caller may try another backend.
+//
+// The connection is closed when it has been idle according to the given timeouts, see [IdleTracker]. The returned stats
+// describe the connection once it has been closed.
+func (b *Backend) HandleConn(ctx context.Context, c net.Conn, timeouts IdleTimeouts) (ConnStats, error) {
 	b.log.V(3).Info("handling incoming connection", "remote", c.RemoteAddr().String())
+	if b.stopped.Load() {
+		return ConnStats{}, ErrStopped
+	}
+	active := b.activeConns.Add(1)
+	defer b.activeConns.Add(-1)
+	if b.maxConns > 0 && active > int64(b.maxConns) {
+		return ConnStats{}, ErrConnectionLimit
+	}
+	defer b.metrics.ConnOpened()()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.mux.Lock()
+	state := b.state
+	b.conns[&cancel] = struct{}{}
+	b.mux.Unlock()
 	defer func() {
-		// make sure that the client connection is closed. It might have already
-		// been closed before so we check for net.ErrClosed.
-		if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
-			b.log.Error(err, "failed closing client connection")
-		}
+		b.mux.Lock()
+		delete(b.conns, &cancel)
+		b.mux.Unlock()
 	}()
-	var dialer net.Dialer
-	beconn, err := dialer.DialContext(ctx, b.Network, b.Addr)
+	if state == StateMaintenance {
+		return ConnStats{}, ErrMaintenance
+	}
+
+	start := time.Now()
+	beconn, err := b.connect(ctx, c)
 	if err != nil {
-		b.setHealth(false, err)
-		return fmt.Errorf("error dialing backend %s %s: %w", b.Network, b.Addr, err)
+		return ConnStats{}, err
 	}
+	stats := ConnStats{ConnectDuration: time.Since(start)}
 
-	quitChan := make(chan struct{})
-	beDirChan := b.proxy(b.log, beconn, c, quitChan, keepaliveChan)
-	clDirChan := b.proxy(b.log, c, beconn, quitChan, keepaliveChan)
+	// the backend connection is only observed when needed, see observedConn.
+	var observed *observedConn
+	if b.outlierDetection != nil {
+		observed = &observedConn{Conn: beconn}
+		beconn = observed
+	}
+	idle := &connIdleness{timeout: timeouts.Idle}
+	toBackend, toClient := idle.tracker(timeouts.Client), idle.tracker(timeouts.Backend)
+	beDirChan := b.proxy(b.log, beconn, c, toBackend, b.metrics.Transferred(metrics.DirectionToBackend))
+	clDirChan := b.proxy(b.log, c, beconn, toClient, b.metrics.Transferred(metrics.DirectionToClient))
 
-	defer func() {
-		// close connections and wait for goroutines to shut down
-		if err := beconn.Close(); err != nil {
-			b.log.Error(err, "failed closing backend connection")
+	var backendClosed bool
+	stats.CloseReason, backendClosed = awaitDirections(ctx, beDirChan, clDirChan)
+
+	// close connections and wait for goroutines to shut down
+	if err := beconn.Close(); err != nil {
+		b.log.Error(err, "failed closing backend connection")
+	}
+	// the client connection might have been closed already, e.g. by the frontend shutting down.
+	if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		b.log.Error(err, "failed closing client connection after handling proxy requests")
+	}
+	<-clDirChan
+	<-beDirChan
+	stats.BytesToBackend, stats.BytesToClient = toBackend.transferred, toClient.transferred
+
+	if observed != nil {
+		if ok, err := observed.outcome(backendClosed, b.outlierDetection.FirstByteTimeout); ok || err != nil {
+			b.recordOutcome(err)
+		}
+	}
+
+	return stats, nil
+}
+
+// awaitDirections waits until both directions of a connection have been finished, one of them failed or ctx is done.
+// It returns why the connection is closed and whether the backend ended its direction.
+func awaitDirections(ctx context.Context, toBackend, toClient <-chan error) (CloseReason, bool) {
+	var backendClosed bool
+	var reason CloseReason
+	for toBackend != nil || toClient != nil {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return CloseMaxLifetime, backendClosed
+			}
+			return CloseCanceled, backendClosed
+		case err := <-toBackend:
+			if err != nil {
+				return closeReason(err, CloseClientEOF), backendClosed
+			}
+			reason = cmp.Or(reason, CloseClientEOF)
+			toBackend = nil
+		case err := <-toClient:
+			backendClosed = true
+			if err != nil {
+				return closeReason(err, CloseBackendEOF), backendClosed
+			}
+			reason = cmp.Or(reason, CloseBackendEOF)
+			toClient = nil
 		}
-		if err := c.Close(); err != nil {
-			b.log.Error(err, "failed closing client connection after handling proxy requests")
+	}
+	return reason, backendClosed
+}
+
+// closeReason returns the reason for closing a connection after copying one of its directions failed with err. eof
+// is the reason if the side the direction is read from closed the connection.
+func closeReason(err error, eof CloseReason) CloseReason {
+	switch {
+	case errors.Is(err, io.EOF):
+		return eof
+	case errors.Is(err, errIdle):
+		return CloseIdleTimeout
+	default:
+		return CloseError
+	}
+}
+
+// connect establishes the connection to the backend application for proxying c. Unless ctx is done, failures count as
+// failed health checks, so they only make the backend unhealthy after the configured number of consecutive failures
+// (see [WithHealthThresholds]), and are passed on to outlier detection.
+func (b *Backend) connect(ctx context.Context, c net.Conn) (net.Conn, error) {
+	connectTimeout := b.connectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	dialer := net.Dialer{Timeout: connectTimeout}
+	beconn, err := dialer.DialContext(ctx, b.Network, b.Addr)
+	if err != nil {
+		// a canceled dial doesn't say anything about the backend's health.
+		if ctx.Err() == nil {
+			b.metrics.DialError()
+			b.recordCheck(err)
+			b.recordOutcome(err)
 		}
-		<-clDirChan
-		<-beDirChan
-	}()
+		return nil, fmt.Errorf("error dialing backend %s %s: %w", b.Network, b.Addr, err)
+	}
+
+	conn, err := b.initConn(ctx, beconn, c, connectTimeout)
+	if err != nil {
+		if closeErr := beconn.Close(); closeErr != nil {
+			b.log.Error(closeErr, "failed closing backend connection")
+		}
+		if ctx.Err() == nil {
+			b.recordCheck(err)
+			b.recordOutcome(err)
+		}
+		return nil, fmt.Errorf("error connecting to backend %s %s: %w", b.Network, b.Addr, err)
+	}
+	return conn, nil
+}
+
+// initConn sends the PROXY protocol header for the client connection c to the backend and completes the TLS handshake
+// within the given timeout if the backend uses TLS. It returns the connection to be used for proxying.
+func (b *Backend) initConn(ctx context.Context, conn, c net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := proxyproto.WriteHeader(conn, b.ProxyProtocol, c.RemoteAddr(), c.LocalAddr()); err != nil {
+		return nil, fmt.Errorf("error sending PROXY protocol header: %w", err)
+	}
+	if b.tlsConfig == nil {
+		return conn, nil
+	}
 
-	select {
-	case <-ctx.Done():
-		close(quitChan)
-		return nil
-	case <-beDirChan:
-		close(quitChan)
-		return nil
-	case <-clDirChan:
-		close(quitChan)
-		return nil
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfigFor(b.tlsConfig, b.Addr))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
 	}
+	return tlsConn, nil
 }
 
 func (b *Backend) setHealth(healthy bool, err error) {
@@ -204,24 +607,59 @@ func (b *Backend) setHealth(healthy bool, err error) {
 	b.healthy = new(healthy)
 	b.LastErr = err
 	b.mux.Unlock()
+	b.metrics.SetHealthy(healthy)
 }
 
-func (b *Backend) checkHealth() {
+func (b *Backend) checkHealth(ctx context.Context, timeout time.Duration) {
 	b.log.V(5).Info("checking health", "backend", b)
-	var dialer net.Dialer
-	conn, err := dialer.DialContext(context.Background(), b.Network, b.Addr) // TODO: use an actual context here.
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	err := b.checker.Check(checkCtx, b.Network, b.Addr)
+	if ctx.Err() != nil {
+		// the backend has been stopped.
+		return
+	}
+	b.metrics.ObserveHealthCheck(time.Since(start))
+	if err != nil && checkCtx.Err() != nil {
+		err = fmt.Errorf("health check timed out after %s: %w", timeout, err)
+	}
+	b.recordCheck(err)
+}
+
+// recordCheck updates the backend's health according to the result of a health check or a connection attempt. The
+// health only changes after the configured number of consecutive successful or failed checks, except for the first
+// check which determines the initial health.
+func (b *Backend) recordCheck(err error) {
+	b.mux.Lock()
+	known, healthy := b.healthy != nil, b.healthy != nil && *b.healthy
+	if err != nil {
+		b.successes = 0
+		b.failures++
+	} else {
+		b.failures = 0
+		b.successes++
+	}
+	successes, failures := b.successes, b.failures
+	b.mux.Unlock()
+
 	if err != nil {
-		if b.healthy == nil || *b.healthy {
-			b.log.V(2).Info("backend got unhealthy", "backend", b)
+		if healthy && failures < max(b.fall, 1) {
+			b.log.V(4).Info("health check failed", "backend", b.Addr, "failures", failures, "err", err.Error())
+			return
+		}
+		if !known || healthy {
+			b.log.V(2).Info("backend got unhealthy", "backend", b.Addr, "err", err.Error())
 		}
 		b.setHealth(false, err)
-
 		return
 	}
-	if err := conn.Close(); err != nil {
-		b.setHealth(false, err)
+
+	if known && !healthy && successes < max(b.rise, 1) {
+		b.log.V(4).Info("health check succeeded", "backend", b.Addr, "successes", successes)
+		return
 	}
-	if b.healthy == nil || !*b.healthy {
+	if !healthy {
 		b.log.V(2).Info("backend got healthy", "backend", b.Addr)
 	}
 	b.setHealth(true, nil)
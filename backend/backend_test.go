@@ -2,6 +2,7 @@ package backend_test
 
 import (
 	"context"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/stdr"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 
 	"github.com/makkes/l4proxy/backend"
@@ -56,7 +58,7 @@ func TestNewBackendWithCustomProxy(t *testing.T) {
 
 	pConn, _ := net.Pipe()
 	var calls atomic.Int32
-	f := func(_ logr.Logger, to net.Conn, from net.Conn, _ <-chan struct{}, _ chan<- struct{}) <-chan struct{} {
+	f := func(_ logr.Logger, to net.Conn, from net.Conn, _ *backend.IdleTracker, _ prometheus.Counter) <-chan error {
 		cnt := calls.Add(1)
 		// first, the connection from client to backend should be proxied
 		if cnt == 1 {
@@ -70,14 +72,15 @@ func TestNewBackendWithCustomProxy(t *testing.T) {
 			require.Equal(t, pConn.RemoteAddr(), to.RemoteAddr())
 		}
 
-		res := make(chan struct{})
+		res := make(chan error)
 		close(res)
 		return res
 	}
 
 	b := backend.NewBackend(backendSrvListener.Addr().Network(), backendSrvListener.Addr().String(), logr.Discard(), backend.WithProxyFunc(f))
 
-	require.NoError(t, b.HandleConn(t.Context(), pConn, nil), "handling connection should succeed")
+	_, err = b.HandleConn(t.Context(), pConn, backend.IdleTimeouts{})
+	require.NoError(t, err, "handling connection should succeed")
 	require.NoError(t, pConn.Close(), "closing pipe should succeed")
 	require.Equal(t, int32(2), calls.Load(), "proxy should be called twice, for the client=>backend and for the backend=>client connection")
 }
@@ -127,8 +130,11 @@ func TestTCPConnectionHandling(t *testing.T) {
 	}()
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	keepaliveChan := make(chan struct{}, 2)
-	require.NoError(t, b.HandleConn(ctx, clientOut, keepaliveChan))
+	stats, err := b.HandleConn(ctx, clientOut, backend.IdleTimeouts{Idle: time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), stats.BytesToBackend)
+	require.Equal(t, int64(14), stats.BytesToClient)
+	require.Positive(t, stats.ConnectDuration)
 }
 
 func TestUDPConnectionHandling(t *testing.T) {
@@ -177,6 +183,79 @@ func TestUDPConnectionHandling(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	keepaliveChan := make(chan struct{}, 2)
-	require.NoError(t, b.HandleConn(ctx, clientOut, keepaliveChan))
+	_, err = b.HandleConn(ctx, clientOut, backend.IdleTimeouts{Idle: time.Minute})
+	require.NoError(t, err)
+}
+
+func TestMaintenanceClosesConnections(t *testing.T) {
+	t.Parallel()
+
+	b := backend.NewBackend("tcp4", startEchoServer(t), logr.Discard())
+	require.Equal(t, backend.StateReady, b.State())
+
+	client, proxied := net.Pipe()
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+	errCh := make(chan error)
+	var stats backend.ConnStats
+	go func() {
+		var err error
+		stats, err = b.HandleConn(t.Context(), proxied, backend.IdleTimeouts{Idle: time.Minute})
+		errCh <- err
+	}()
+	// make sure that the connection is being proxied.
+	_, err := client.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+
+	b.SetState(backend.StateMaintenance)
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		require.Equal(t, backend.CloseCanceled, stats.CloseReason)
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection should have been closed")
+	}
+
+	client2, proxied2 := net.Pipe()
+	t.Cleanup(func() {
+		require.NoError(t, client2.Close())
+	})
+	_, err = b.HandleConn(t.Context(), proxied2, backend.IdleTimeouts{Idle: time.Minute})
+	require.ErrorIs(t, err, backend.ErrMaintenance)
+}
+
+func TestMatchServerName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		names      []string
+		serverName string
+		match      bool
+	}{
+		{nil, "app.example.com", true},
+		{[]string{"app.example.com"}, "app.example.com", true},
+		{[]string{"App.Example.com."}, "app.example.com", true},
+		{[]string{"app.example.com"}, "other.example.com", false},
+		{[]string{"*.example.com"}, "app.example.com", true},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "", false},
+		{[]string{"app.example.com"}, "", false},
+	}
+	for _, tt := range tests {
+		b := backend.NewBackend("tcp4", "127.0.0.1:443", logr.Discard(), backend.WithServerNames(tt.names...))
+		require.Equal(t, tt.match, b.MatchServerName(tt.serverName) >= 0, "names %v, server name %q", tt.names, tt.serverName)
+	}
+
+	exact := backend.NewBackend("tcp4", "127.0.0.1:443", logr.Discard(), backend.WithServerNames("app.example.com"))
+	long := backend.NewBackend("tcp4", "127.0.0.1:443", logr.Discard(), backend.WithServerNames("*.app.example.com"))
+	short := backend.NewBackend("tcp4", "127.0.0.1:443", logr.Discard(), backend.WithServerNames("*.example.com"))
+	fallback := backend.NewBackend("tcp4", "127.0.0.1:443", logr.Discard())
+	require.Greater(t, exact.MatchServerName("app.example.com"), short.MatchServerName("app.example.com"))
+	require.Greater(t, long.MatchServerName("a.app.example.com"), short.MatchServerName("a.app.example.com"))
+	require.Greater(t, short.MatchServerName("a.app.example.com"), fallback.MatchServerName("a.app.example.com"))
 }
@@ -0,0 +1,271 @@
+package backend
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+// errIdle ends copying when both directions of a connection are idle.
+var errIdle = errors.New("connection is idle")
+
+const (
+	// chunkSize is the maximum number of bytes copied at once from a stream.
+	chunkSize = 1 << 20
+	// flushInterval is the maximum time a direction transferring data copies before the transferred bytes are
+	// recorded.
+	flushInterval = time.Second
+	// streamBufferSize is the size of the buffer used for streams that the kernel can't copy on its own.
+	streamBufferSize = 32 * 1024
+	// datagramBufferSize is large enough to hold any UDP datagram so that datagrams are never truncated.
+	datagramBufferSize = 65535
+)
+
+// IdleTimeouts configures when connections handled by [Backend.HandleConn] are closed for being idle. Zero values
+// disable the respective timeout.
+type IdleTimeouts struct {
+	// Idle closes connections on which no data has been transferred in either direction.
+	Idle time.Duration
+	// Client closes connections on which the client hasn't sent any data, regardless of the data sent by the backend.
+	Client time.Duration
+	// Backend closes connections on which the backend hasn't sent any data, regardless of the data sent by the client.
+	Backend time.Duration
+}
+
+// connIdleness holds the state shared by the [IdleTracker]s of both directions of a connection.
+type connIdleness struct {
+	timeout time.Duration
+	idle    atomic.Int32
+}
+
+// tracker returns the tracker of a single direction. The direction is idle after it hasn't transferred data for the
+// given timeout, which is disabled if zero.
+func (c *connIdleness) tracker(timeout time.Duration) *IdleTracker {
+	return &IdleTracker{conn: c, timeout: timeout, lastActive: time.Now()}
+}
+
+// IdleTracker detects when a single direction of a connection hasn't transferred any data for its timeout and, together
+// with the tracker of the other direction, when no data has been transferred in either direction for the connection's
+// idle timeout. Instead of reporting every transfer, copying is interrupted regularly by a read deadline and checks for
+// idleness then. An IdleTracker is only accessed by the goroutine copying the direction's data.
+type IdleTracker struct {
+	conn       *connIdleness
+	timeout    time.Duration
+	lastActive time.Time
+	idle       bool
+	// transferred is the number of bytes transferred in the direction.
+	transferred int64
+}
+
+// interval returns the time after which copying is interrupted. Besides detecting idleness, this makes sure that the
+// transferred bytes are recorded in time.
+func (t *IdleTracker) interval() time.Duration {
+	interval := flushInterval
+	for _, timeout := range []time.Duration{t.timeout, t.conn.timeout} {
+		if timeout > 0 {
+			interval = min(interval, timeout)
+		}
+	}
+	return interval
+}
+
+// record records the number of bytes transferred by a copy. It reports whether the connection should be closed for
+// being idle.
+func (t *IdleTracker) record(n int64) bool {
+	if n > 0 {
+		t.transferred += n
+		t.lastActive = time.Now()
+		if t.idle {
+			t.idle = false
+			t.conn.idle.Add(-1)
+		}
+		return false
+	}
+	idleFor := time.Since(t.lastActive)
+	if t.timeout > 0 && idleFor >= t.timeout {
+		return true
+	}
+	if t.idle || t.conn.timeout <= 0 || idleFor < t.conn.timeout {
+		return false
+	}
+	t.idle = true
+	return t.conn.idle.Add(1) >= 2
+}
+
+// finish marks a direction that won't transfer any more data so that the connection is idle as soon as the other
+// direction is.
+func (t *IdleTracker) finish() {
+	if !t.idle {
+		t.idle = true
+		t.conn.idle.Add(1)
+	}
+}
+
+// proxy copies data from one connection to the other until the end of the stream has been reached, reading or writing
+// fails or the connection has been idle (see [IdleTracker]). The number of bytes written is added to written unless it
+// is nil.
+//
+// The returned channel receives nil when the end of the stream has been propagated to the other connection by closing
+// its writing side. The other direction of the connection may still transfer data then (half-close). Otherwise, the
+// channel receives the error that ended copying. The channel is closed afterwards.
+func proxy(log logr.Logger, to, from net.Conn, idle *IdleTracker, written prometheus.Counter) <-chan error {
+	res := make(chan error, 1)
+	log = log.WithName(fmt.Sprintf("%s->%s", from.RemoteAddr().String(), to.RemoteAddr().String()))
+	go func() {
+		defer close(res)
+		err := copyDirection(to, from, idle, written)
+		switch {
+		case err == nil:
+			log.V(4).Info("connection has been half-closed", "conn", from.RemoteAddr().String())
+		case errors.Is(err, errIdle):
+			log.V(5).Info("connection is idle, closing")
+		default:
+			logConnErr(log, err, from.RemoteAddr().String(), from.RemoteAddr().String(), "error proxying connection")
+		}
+		res <- err
+	}()
+	return res
+}
+
+// copyDirection copies the data of a single direction of a connection. It returns nil when the end of the stream has
+// been reached and the writing side of to has been closed.
+//
+// Streams are copied in chunks of up to a MiB or a second. When both connections are plain TCP connections, the kernel
+// moves the data between them without copying it to user space (splice on Linux).
+func copyDirection(to, from net.Conn, idle *IdleTracker, written prometheus.Counter) error {
+	src, datagram := unwrapConn(from), isDatagram(from)
+	dst, buf := copyTarget(unwrapConn(to), src, datagram)
+	for {
+		if err := src.SetReadDeadline(time.Now().Add(idle.interval())); err != nil {
+			return fmt.Errorf("failed setting read deadline: %w", err)
+		}
+		n, err := copyChunk(dst, src, buf, datagram)
+		if n > 0 && written != nil {
+			written.Add(float64(n))
+		}
+		if idle.record(n) {
+			return errIdle
+		}
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+		if err := halfClose(to, from); err != nil {
+			return err
+		}
+		idle.finish()
+		return nil
+	}
+}
+
+// copyTarget returns the writer to copy to and the buffer to copy through, which is nil if the kernel can copy the
+// data on its own.
+func copyTarget(dst, src net.Conn, datagram bool) (io.Writer, []byte) {
+	switch {
+	case datagram:
+		return dst, make([]byte, datagramBufferSize)
+	case !isTCP(src) || !isTCP(dst):
+		// hide io.ReaderFrom so that the same buffer is used for all chunks.
+		return writerOnly{dst}, make([]byte, streamBufferSize)
+	default:
+		return dst, nil
+	}
+}
+
+// halfClose propagates the end of the stream read from from by closing the writing side of to. It returns [io.EOF]
+// if either connection doesn't support half-closing, in which case from has been closed completely.
+func halfClose(to, from net.Conn) error {
+	closeTo := writeCloser(to)
+	if closeTo == nil || writeCloser(from) == nil {
+		return io.EOF
+	}
+	return closeTo()
+}
+
+// copyChunk copies a single datagram or up to chunkSize bytes of a stream from src to dst. buf may be nil if dst
+// implements [io.ReaderFrom]. It returns [io.EOF] when the end of the stream has been reached.
+func copyChunk(dst io.Writer, src net.Conn, buf []byte, datagram bool) (int64, error) {
+	if datagram {
+		n, err := src.Read(buf)
+		if err != nil {
+			return 0, err //nolint:wrapcheck // the error is passed on unchanged on purpose.
+		}
+		n, err = dst.Write(buf[:n])
+		return int64(n), err //nolint:wrapcheck // see above.
+	}
+
+	lr := &io.LimitedReader{R: src, N: chunkSize}
+	n, err := io.CopyBuffer(dst, lr, buf)
+	if err == nil && lr.N > 0 {
+		return n, io.EOF
+	}
+	return n, err //nolint:wrapcheck // the error is passed on unchanged on purpose.
+}
+
+// unwrapConn returns the TCP connection underlying connections that only report different addresses so that the
+// kernel can copy their data.
+func unwrapConn(c net.Conn) net.Conn {
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		return pc.NetConn()
+	}
+	return c
+}
+
+func isTCP(c any) bool {
+	_, ok := c.(*net.TCPConn)
+	return ok
+}
+
+// isDatagram reports whether c is datagram-oriented. Every read from such a connection consumes a whole datagram so
+// the buffer must be large enough for the largest possible datagram.
+func isDatagram(c net.Conn) bool {
+	return strings.HasPrefix(c.LocalAddr().Network(), "udp")
+}
+
+// writeCloser returns a function shutting down the writing side of c or nil if c doesn't support that. Wrapped
+// connections are unwrapped if they don't support it on their own.
+func writeCloser(c net.Conn) func() error {
+	switch conn := c.(type) {
+	case *tls.Conn:
+		next := writeCloser(conn.NetConn())
+		if next == nil {
+			return nil
+		}
+		return func() error {
+			// this only sends a close_notify alert so the underlying connection is closed for writing, too.
+			if err := conn.CloseWrite(); err != nil {
+				return fmt.Errorf("failed closing TLS connection for writing: %w", err)
+			}
+			return next()
+		}
+	case interface{ CloseWrite() error }:
+		return func() error {
+			if err := conn.CloseWrite(); err != nil {
+				return fmt.Errorf("failed closing connection for writing: %w", err)
+			}
+			return nil
+		}
+	case interface{ NetConn() net.Conn }:
+		return writeCloser(conn.NetConn())
+	default:
+		return nil
+	}
+}
+
+// writerOnly hides all methods of a writer but Write.
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+// HealthChecker checks whether a backend is able to serve traffic.
+type HealthChecker interface {
+	// Check returns an error if the backend listening on the given network address is unhealthy. The check must not
+	// take longer than ctx's deadline.
+	Check(ctx context.Context, network, addr string) error
+}
+
+// proxyProtocolChecker is implemented by the health checks that can send a PROXY protocol header. Backends sending
+// PROXY protocol headers make their health checks send them, too, see [WithProxyProtocol].
+type proxyProtocolChecker interface {
+	// withProxyProtocol returns a copy of the check sending a header of the given version unless the check already
+	// sends one.
+	withProxyProtocol(v proxyproto.Version) HealthChecker
+}
+
+// maxHealthCheckResponse is the maximum number of bytes read from a backend's response for matching it against the
+// expected response.
+const maxHealthCheckResponse = 64 * 1024
+
+// TCPCheck checks the health of a backend by connecting to it. If Send is set, it's sent to the backend after the
+// connection has been established. If Expect is set, the backend is only considered healthy if its response contains
+// Expect, e.g. a banner like "SSH-" or a reply like "+PONG" to a Redis "PING\r\n".
+type TCPCheck struct {
+	Send   []byte
+	Expect []byte
+	// ProxyProtocol makes the check send a PROXY protocol header of the given version, see [dialCheck].
+	ProxyProtocol proxyproto.Version
+}
+
+// Check implements [HealthChecker].
+func (c TCPCheck) Check(ctx context.Context, network, addr string) (err error) {
+	conn, err := dialCheck(ctx, network, addr, c.ProxyProtocol)
+	if err != nil {
+		return fmt.Errorf("failed connecting: %w", err)
+	}
+	defer closeChecked(conn, &err)
+
+	return c.exchange(ctx, conn)
+}
+
+func (c TCPCheck) exchange(ctx context.Context, conn net.Conn) error {
+	if len(c.Send) == 0 && len(c.Expect) == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("failed setting deadline: %w", err)
+		}
+	}
+
+	if len(c.Send) > 0 {
+		if _, err := conn.Write(c.Send); err != nil {
+			return fmt.Errorf("failed sending health check payload: %w", err)
+		}
+	}
+	if len(c.Expect) == 0 {
+		return nil
+	}
+
+	resp := make([]byte, 0, len(c.Expect))
+	buf := make([]byte, 4096)
+	for len(resp) < maxHealthCheckResponse {
+		n, err := conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if bytes.Contains(resp, c.Expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("expected response %q not received: %w", c.Expect, err)
+		}
+	}
+	return fmt.Errorf("expected response %q not received within %d bytes", c.Expect, maxHealthCheckResponse)
+}
+
+// TLSCheck checks the health of a backend by connecting to it and completing a TLS handshake.
+type TLSCheck struct {
+	// Config is used for the handshake. If it doesn't set a ServerName, the host part of the backend's address is
+	// used.
+	Config *tls.Config
+	// ProxyProtocol makes the check send a PROXY protocol header of the given version before the handshake, see
+	// [dialCheck].
+	ProxyProtocol proxyproto.Version
+}
+
+// Check implements [HealthChecker].
+func (c TLSCheck) Check(ctx context.Context, network, addr string) (err error) {
+	conn, err := dialCheck(ctx, network, addr, c.ProxyProtocol)
+	if err != nil {
+		return fmt.Errorf("failed connecting: %w", err)
+	}
+	tlsConn := tls.Client(conn, tlsConfigFor(c.Config, addr))
+	defer closeChecked(tlsConn, &err)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return nil
+}
+
+// HTTPCheck checks the health of a backend by sending an HTTP GET request to it.
+type HTTPCheck struct {
+	// Path is the path requested from the backend. Defaults to "/".
+	Path string
+	// Host is sent as Host header. Defaults to the backend's address.
+	Host string
+	// TLS makes the check use HTTPS with the given configuration. If it doesn't set a ServerName, Host is used or the
+	// host part of the backend's address if Host is empty.
+	TLS *tls.Config
+	// ExpectStatus lists the status codes indicating a healthy backend. Defaults to all 2xx and 3xx codes.
+	ExpectStatus []int
+	// ExpectBody makes the backend only healthy if the response body contains it.
+	ExpectBody string
+	// ProxyProtocol makes the check send a PROXY protocol header of the given version before the request, see
+	// [dialCheck].
+	ProxyProtocol proxyproto.Version
+}
+
+// Check implements [HealthChecker].
+func (c HTTPCheck) Check(ctx context.Context, network, addr string) (err error) {
+	scheme := "http"
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialCheck(ctx, network, addr, c.ProxyProtocol)
+		},
+	}
+	if c.TLS != nil {
+		scheme = "https"
+		serverName := addr
+		if c.Host != "" {
+			serverName = c.Host
+		}
+		transport.TLSClientConfig = tlsConfigFor(c.TLS, serverName)
+	}
+	client := &http.Client{
+		Transport: transport,
+		// redirects are reported as is so that they can be matched against the expected status codes.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+addr+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed creating health check request: %w", err)
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	req.Header.Set("User-Agent", "l4proxy-health-check")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check request failed: %w", err)
+	}
+	defer closeChecked(resp.Body, &err)
+
+	if !c.statusOK(resp.StatusCode) {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	if c.ExpectBody == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckResponse))
+	if err != nil {
+		return fmt.Errorf("failed reading health check response: %w", err)
+	}
+	if !strings.Contains(string(body), c.ExpectBody) {
+		return fmt.Errorf("response body doesn't contain %q", c.ExpectBody)
+	}
+	return nil
+}
+
+func (c HTTPCheck) statusOK(code int) bool {
+	if len(c.ExpectStatus) == 0 {
+		return code >= 200 && code < 400
+	}
+	return slices.Contains(c.ExpectStatus, code)
+}
+
+// dialCheck connects to the backend for a health check. Backends that expect a PROXY protocol header on each
+// connection reject connections without one, so a header of version v announcing a connection of the proxy itself is
+// sent (see [proxyproto.WriteLocalHeader]) unless v is [proxyproto.None].
+func dialCheck(ctx context.Context, network, addr string, v proxyproto.Version) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // the callers add context.
+	}
+	if err := proxyproto.WriteLocalHeader(conn, v); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	return conn, nil
+}
+
+// withProxyProtocol implements [proxyProtocolChecker].
+func (c TCPCheck) withProxyProtocol(v proxyproto.Version) HealthChecker {
+	c.ProxyProtocol = cmp.Or(c.ProxyProtocol, v)
+	return c
+}
+
+// withProxyProtocol implements [proxyProtocolChecker].
+func (c TLSCheck) withProxyProtocol(v proxyproto.Version) HealthChecker {
+	c.ProxyProtocol = cmp.Or(c.ProxyProtocol, v)
+	return c
+}
+
+// withProxyProtocol implements [proxyProtocolChecker].
+func (c HTTPCheck) withProxyProtocol(v proxyproto.Version) HealthChecker {
+	c.ProxyProtocol = cmp.Or(c.ProxyProtocol, v)
+	return c
+}
+
+// tlsConfigFor returns a copy of cfg with its ServerName set to the host part of hostPort unless it has already been
+// set.
+func tlsConfigFor(cfg *tls.Config, hostPort string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{} //nolint:gosec // the minimum version is left to the defaults of the tls package.
+	}
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			host = hostPort
+		}
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// closeChecked closes c and makes the health check fail with the resulting error unless it has already failed.
+func closeChecked(c io.Closer, err *error) {
+	if closeErr := c.Close(); closeErr != nil && *err == nil {
+		*err = fmt.Errorf("failed closing connection: %w", closeErr)
+	}
+}
@@ -0,0 +1,345 @@
+package backend_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+func TestTCPCheckSendExpect(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, l.Close())
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					require.NoError(t, conn.Close())
+				}()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				reply := "-ERR\r\n"
+				if line == "PING\r\n" {
+					reply = "+PONG\r\n"
+				}
+				if _, err := conn.Write([]byte(reply)); err != nil {
+					return
+				}
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		check   backend.TCPCheck
+		healthy bool
+	}{
+		{name: "connect only", check: backend.TCPCheck{}, healthy: true},
+		{name: "expected reply", check: backend.TCPCheck{Send: []byte("PING\r\n"), Expect: []byte("+PONG")}, healthy: true},
+		{name: "unexpected reply", check: backend.TCPCheck{Send: []byte("HELLO\r\n"), Expect: []byte("+PONG")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
+			defer cancel()
+			err := tt.check.Check(ctx, "tcp4", l.Addr().String())
+			if tt.healthy {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "app.example.com" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		if _, err := w.Write([]byte("status: ok")); err != nil {
+			t.Errorf("failed writing response: %s", err)
+		}
+	})
+	mux.HandleFunc("/unavailable", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	tlsSrv := httptest.NewTLSServer(mux)
+	t.Cleanup(tlsSrv.Close)
+	transport, ok := tlsSrv.Client().Transport.(*http.Transport)
+	require.True(t, ok)
+
+	tests := []struct {
+		name    string
+		check   backend.HTTPCheck
+		https   bool
+		healthy bool
+	}{
+		{
+			name:    "expected body",
+			check:   backend.HTTPCheck{Path: "/healthz", Host: "app.example.com", ExpectBody: "ok"},
+			healthy: true,
+		},
+		{
+			name:  "unexpected body",
+			check: backend.HTTPCheck{Path: "/healthz", Host: "app.example.com", ExpectBody: "ready"},
+		},
+		{
+			name:  "unexpected status",
+			check: backend.HTTPCheck{Path: "/unavailable"},
+		},
+		{
+			name:    "expected status",
+			check:   backend.HTTPCheck{Path: "/unavailable", ExpectStatus: []int{http.StatusServiceUnavailable}},
+			healthy: true,
+		},
+		{
+			name: "HTTPS",
+			check: backend.HTTPCheck{
+				Path: "/healthz",
+				Host: "app.example.com",
+				TLS:  &tls.Config{RootCAs: transport.TLSClientConfig.RootCAs, ServerName: "example.com"}, //nolint:gosec // test
+			},
+			https:   true,
+			healthy: true,
+		},
+		{
+			name:  "HTTPS with untrusted certificate",
+			check: backend.HTTPCheck{Path: "/healthz", Host: "app.example.com", TLS: &tls.Config{ServerName: "example.com"}},
+			https: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			addr := srv.Listener.Addr().String()
+			if tt.https {
+				addr = tlsSrv.Listener.Addr().String()
+			}
+			ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
+			defer cancel()
+			err := tt.check.Check(ctx, "tcp4", addr)
+			if tt.healthy {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTLSCheck(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	plain := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(plain.Close)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
+	defer cancel()
+	//nolint:gosec // the test server's certificate is self-signed.
+	check := backend.TLSCheck{Config: &tls.Config{InsecureSkipVerify: true}}
+	require.NoError(t, check.Check(ctx, "tcp4", srv.Listener.Addr().String()))
+	require.Error(t, check.Check(ctx, "tcp4", plain.Listener.Addr().String()), "plain text server should be unhealthy")
+}
+
+type checkFunc func(ctx context.Context) error
+
+func (f checkFunc) Check(ctx context.Context, _, _ string) error {
+	return f(ctx)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	t.Parallel()
+
+	b := backend.NewBackend("tcp4", "127.0.0.1:1", logr.Discard(),
+		backend.WithHealthChecker(checkFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})),
+		backend.WithHealthCheckTimeout(50*time.Millisecond))
+	require.NoError(t, b.Start(60))
+	t.Cleanup(b.Stop)
+
+	require.Eventually(t, func() bool { return b.LastError() != nil }, 3*time.Second, 10*time.Millisecond)
+	require.False(t, b.IsHealthy())
+	require.ErrorContains(t, b.LastError(), "timed out")
+}
+
+func TestHealthThresholds(t *testing.T) {
+	t.Parallel()
+
+	// the backend is healthy after the first check and needs two failed checks for becoming unhealthy.
+	results := make(chan error, 3)
+	results <- nil
+	results <- errors.New("first failure")
+	results <- errors.New("second failure")
+	checks := make(chan struct{}, 3)
+	b := backend.NewBackend("tcp4", "127.0.0.1:1", logr.Discard(),
+		backend.WithHealthChecker(checkFunc(func(context.Context) error {
+			defer func() { checks <- struct{}{} }()
+			select {
+			case err := <-results:
+				return err
+			default:
+				return errors.New("no more results")
+			}
+		})),
+		backend.WithHealthThresholds(1, 2),
+		backend.WithHealthCheckJitter(time.Millisecond))
+	require.NoError(t, b.Start(1))
+	t.Cleanup(b.Stop)
+
+	for idx, healthy := range []bool{true, true, false} {
+		select {
+		case <-checks:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("check %d hasn't been run", idx+1)
+		}
+		require.Eventually(t, func() bool { return b.IsHealthy() == healthy }, time.Second, 10*time.Millisecond,
+			"unexpected health after check %d", idx+1)
+	}
+}
+
+// proxyProtocolListener only accepts connections starting with a PROXY protocol header, like backend applications
+// configured for the PROXY protocol do. Other connections are closed.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := proxyproto.ReadHeader(conn); err != nil {
+			if err := conn.Close(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func TestHealthChecksSendProxyProtocolHeader(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, l.Close()) })
+	go func() {
+		pl := proxyProtocolListener{l}
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { require.NoError(t, conn.Close()) }()
+				if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil && line == "PING\r\n" {
+					_, err := conn.Write([]byte("+PONG\r\n"))
+					require.NoError(t, err)
+				}
+			}()
+		}
+	}()
+
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Listener = proxyProtocolListener{srv.Listener}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	tlsSrv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsSrv.Listener = proxyProtocolListener{tlsSrv.Listener}
+	tlsSrv.StartTLS()
+	t.Cleanup(tlsSrv.Close)
+
+	ping := backend.TCPCheck{Send: []byte("PING\r\n"), Expect: []byte("+PONG")}
+	httpCheck := backend.HTTPCheck{ExpectStatus: []int{http.StatusNotFound}}
+	tlsCheck := backend.TLSCheck{Config: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec // self-signed certificate.
+	tests := []struct {
+		name  string
+		check backend.HealthChecker
+		addr  string
+	}{
+		{name: "tcp", check: ping, addr: l.Addr().String()},
+		{name: "http", check: httpCheck, addr: srv.Listener.Addr().String()},
+		{name: "tls", check: tlsCheck, addr: tlsSrv.Listener.Addr().String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
+			defer cancel()
+			require.Error(t, tt.check.Check(ctx, "tcp4", tt.addr), "check without header should fail")
+
+			for _, v := range []proxyproto.Version{proxyproto.V1, proxyproto.V2} {
+				b := backend.NewBackend("tcp4", tt.addr, logr.Discard(), backend.WithHealthChecker(tt.check),
+					backend.WithProxyProtocol(v))
+				require.NoError(t, b.Start(60))
+				t.Cleanup(b.Stop)
+				require.Eventually(t, b.IsHealthy, 3*time.Second, 10*time.Millisecond, "PROXY protocol %s", v)
+			}
+		})
+	}
+}
+
+func TestFailedConnectionsRespectFallThreshold(t *testing.T) {
+	t.Parallel()
+
+	// nothing listens on the backend's address so that connecting to it fails while the health check succeeds.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	b := backend.NewBackend("tcp4", addr, logr.Discard(),
+		backend.WithHealthChecker(checkFunc(func(context.Context) error { return nil })),
+		backend.WithHealthThresholds(1, 3))
+	require.NoError(t, b.Start(60))
+	t.Cleanup(b.Stop)
+	require.Eventually(t, b.IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	for idx := range 3 {
+		require.True(t, b.IsHealthy(), "backend should be healthy after %d failed connections", idx)
+		client, _ := net.Pipe()
+		_, err := b.HandleConn(t.Context(), client, backend.IdleTimeouts{})
+		require.Error(t, err)
+	}
+	require.False(t, b.IsHealthy(), "backend should be unhealthy after 3 failed connections")
+	require.ErrorContains(t, b.LastError(), "connection refused")
+}
@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultBaseEjectionTime    = 30 * time.Second
+	defaultMaxEjectionTime     = 5 * time.Minute
+)
+
+// OutlierDetection configures the passive health checking of a backend. Failures observed on proxied connections are
+// counted and the backend is ejected, i.e. doesn't receive new connections, after a number of consecutive failures.
+// Ejection is independent from the active health check. Each consecutive ejection doubles the ejection time.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of consecutive failed connections after which the backend is ejected.
+	// Defaults to 5.
+	ConsecutiveFailures int
+	// BaseEjectionTime is the duration of the first ejection. Defaults to 30 seconds.
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime caps the ejection time. Defaults to 5 minutes.
+	MaxEjectionTime time.Duration
+	// FirstByteTimeout makes connections count as failed when the backend takes longer to respond to the first data
+	// sent by the client. Disabled if zero.
+	FirstByteTimeout time.Duration
+}
+
+// outlierState holds the passive health of a backend. It is guarded by the backend's mutex.
+type outlierState struct {
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// WithOutlierDetection enables passive health checking for the backend. See [OutlierDetection].
+func WithOutlierDetection(od OutlierDetection) Option {
+	return func(b *Backend) {
+		if od.ConsecutiveFailures <= 0 {
+			od.ConsecutiveFailures = defaultConsecutiveFailures
+		}
+		if od.BaseEjectionTime <= 0 {
+			od.BaseEjectionTime = defaultBaseEjectionTime
+		}
+		if od.MaxEjectionTime <= 0 {
+			od.MaxEjectionTime = max(defaultMaxEjectionTime, od.BaseEjectionTime)
+		}
+		b.outlierDetection = &od
+	}
+}
+
+// EjectedUntil returns the time until which the backend has been ejected by outlier detection. The time is in the
+// past if the backend isn't ejected.
+func (b *Backend) EjectedUntil() time.Time {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.outlier.ejectedUntil
+}
+
+// IsEjected reports whether the backend is currently ejected by outlier detection. Ejected backends should not
+// receive new connections.
+func (b *Backend) IsEjected() bool {
+	return time.Now().Before(b.EjectedUntil())
+}
+
+// recordOutcome records the outcome of a proxied connection for outlier detection. A nil error counts as success.
+func (b *Backend) recordOutcome(err error) {
+	od := b.outlierDetection
+	if od == nil {
+		return
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if err == nil {
+		b.outlier.failures = 0
+		if !time.Now().Before(b.outlier.ejectedUntil) {
+			b.outlier.ejections = 0
+		}
+		return
+	}
+
+	b.outlier.failures++
+	if b.outlier.failures < od.ConsecutiveFailures {
+		b.log.V(4).Info("connection to backend failed", "backend", b.Addr, "failures", b.outlier.failures, "err", err.Error())
+		return
+	}
+
+	d := od.BaseEjectionTime << min(b.outlier.ejections, 30)
+	if d <= 0 || d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+	b.outlier.failures = 0
+	b.outlier.ejections++
+	b.outlier.ejectedUntil = time.Now().Add(d)
+	b.metrics.Ejected()
+	b.log.V(1).Info("ejecting backend", "backend", b.Addr, "duration", d.String(), "err", err.Error())
+}
+
+// observedConn records the events on a backend connection that are needed for judging whether the backend behaved
+// correctly. Wrapping the connection keeps the kernel from copying the proxied data on its own.
+type observedConn struct {
+	net.Conn
+	mux        sync.Mutex
+	firstWrite time.Time
+	firstRead  time.Time
+	readErr    error
+}
+
+func (c *observedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mux.Lock()
+	if n > 0 && c.firstRead.IsZero() {
+		c.firstRead = time.Now()
+	}
+	// expired read deadlines only mean that the connection has been idle.
+	if err != nil && c.readErr == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.readErr = err
+	}
+	c.mux.Unlock()
+	return n, err //nolint:wrapcheck // the error is passed on unchanged on purpose.
+}
+
+func (c *observedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.mux.Lock()
+		if c.firstWrite.IsZero() {
+			c.firstWrite = time.Now()
+		}
+		c.mux.Unlock()
+	}
+	return n, err //nolint:wrapcheck // the error is passed on unchanged on purpose.
+}
+
+// NetConn returns the underlying connection.
+func (c *observedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// outcome judges the connection after it has been closed. backendClosed tells whether the backend ended the
+// connection. It returns an error describing the backend's failure or nil if the backend responded correctly. ok is
+// false if the connection doesn't tell anything about the backend, e.g. because no data has been exchanged.
+func (c *observedConn) outcome(backendClosed bool, firstByteTimeout time.Duration) (ok bool, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	switch {
+	case errors.Is(c.readErr, syscall.ECONNRESET):
+		return true, errors.New("connection reset by backend")
+	case backendClosed && c.firstRead.IsZero() && errors.Is(c.readErr, io.EOF):
+		return true, errors.New("backend closed the connection without sending any data")
+	case firstByteTimeout > 0 && !c.firstWrite.IsZero():
+		end := c.firstRead
+		if end.IsZero() {
+			end = time.Now()
+		}
+		if end.Sub(c.firstWrite) > firstByteTimeout {
+			return true, fmt.Errorf("backend didn't respond within %s", firstByteTimeout)
+		}
+	}
+	return !c.firstRead.IsZero(), nil
+}
@@ -0,0 +1,102 @@
+package backend_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+)
+
+func TestOutlierDetectionEjectsBackendClosingConnections(t *testing.T) {
+	t.Parallel()
+
+	// the backend accepts connections but closes them right away.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, l.Close())
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if err := conn.Close(); err != nil {
+				return
+			}
+		}
+	}()
+
+	b := backend.NewBackend("tcp4", l.Addr().String(), logr.Discard(), backend.WithOutlierDetection(backend.OutlierDetection{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Minute,
+	}))
+
+	for idx := range 2 {
+		require.False(t, b.IsEjected(), "backend shouldn't be ejected after %d failures", idx)
+		client, proxied := net.Pipe()
+		_, err := b.HandleConn(t.Context(), proxied, backend.IdleTimeouts{Idle: time.Minute})
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+	}
+
+	require.True(t, b.IsEjected(), "backend should be ejected after 2 failures")
+	require.WithinDuration(t, time.Now().Add(time.Minute), b.EjectedUntil(), 5*time.Second)
+}
+
+func TestOutlierDetectionKeepsRespondingBackend(t *testing.T) {
+	t.Parallel()
+
+	srv := startEchoServer(t)
+	b := backend.NewBackend("tcp4", srv, logr.Discard(), backend.WithOutlierDetection(backend.OutlierDetection{
+		ConsecutiveFailures: 1,
+	}))
+
+	for range 3 {
+		client, proxied := net.Pipe()
+		done := make(chan error)
+		go func() {
+			_, err := b.HandleConn(t.Context(), proxied, backend.IdleTimeouts{Idle: time.Minute})
+			done <- err
+		}()
+		_, err := client.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = client.Read(buf)
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+		require.NoError(t, <-done)
+	}
+
+	require.False(t, b.IsEjected())
+}
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, l.Close())
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					return
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/makkes/l4proxy/accesslog"
+	"github.com/makkes/l4proxy/config"
+)
+
+// accessLogPathStdout is the access log path that makes frontends write their access log to standard output.
+const accessLogPathStdout = "-"
+
+// accessLogs holds the access logs of all frontends. Frontends writing to the same path share the file, which is
+// closed when the last of them has been stopped.
+type accessLogs struct {
+	mux  sync.Mutex
+	logs map[string]*sharedAccessLog
+}
+
+type sharedAccessLog struct {
+	logger *accesslog.Logger
+	// file is nil for standard output.
+	file *accesslog.File
+	refs int
+}
+
+func newAccessLogs() *accessLogs {
+	return &accessLogs{logs: make(map[string]*sharedAccessLog)}
+}
+
+// acquire returns the logger for the given configuration, opening the file if no other frontend uses it yet. It
+// returns nil if cfg is nil. Each call must be paired with a call to release once the logger isn't used anymore.
+func (a *accessLogs) acquire(cfg *config.AccessLog) (*accesslog.Logger, error) {
+	if cfg == nil {
+		return nil, nil //nolint:nilnil // a nil logger disables the access log.
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	maxSize := int64(cfg.MaxSizeMB) << 20
+	if l, ok := a.logs[cfg.Path]; ok {
+		if l.file != nil {
+			l.file.SetRotation(maxSize, cfg.MaxBackups)
+		}
+		l.refs++
+		return l.logger, nil
+	}
+
+	l := &sharedAccessLog{refs: 1}
+	switch cfg.Path {
+	case "":
+		return nil, errors.New("access log path must not be empty")
+	case accessLogPathStdout:
+		l.logger = accesslog.New(os.Stdout)
+	default:
+		file, err := accesslog.OpenFile(cfg.Path, maxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed opening access log: %w", err)
+		}
+		l.logger, l.file = accesslog.New(file), file
+	}
+	a.logs[cfg.Path] = l
+	return l.logger, nil
+}
+
+// release releases a logger returned by acquire for the same configuration.
+func (a *accessLogs) release(cfg *config.AccessLog) error {
+	if cfg == nil {
+		return nil
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	l, ok := a.logs[cfg.Path]
+	if !ok {
+		return nil
+	}
+	if l.refs--; l.refs > 0 {
+		return nil
+	}
+	delete(a.logs, cfg.Path)
+	if l.file == nil {
+		return nil
+	}
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed closing access log: %w", err)
+	}
+	return nil
+}
+
+// reopen reopens all access log files, e.g. after they have been rotated by an external tool.
+func (a *accessLogs) reopen() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	var errs []error
+	for _, l := range a.logs {
+		if l.file == nil {
+			continue
+		}
+		if err := l.file.Reopen(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+)
+
+// adminServer implements the admin API for inspecting the running frontends and changing the state of backends at
+// runtime.
+type adminServer struct {
+	log       logr.Logger
+	frontends func() []*frontend.Frontend
+}
+
+type frontendStatus struct {
+	Name              string          `json:"name"`
+	Network           string          `json:"network"`
+	Address           string          `json:"address"`
+	ActiveConnections int             `json:"active_connections"`
+	Backends          []backendStatus `json:"backends"`
+}
+
+type backendStatus struct {
+	Frontend          string        `json:"frontend,omitempty"`
+	Address           string        `json:"address"`
+	Network           string        `json:"network"`
+	Weight            int           `json:"weight"`
+	ServerNames       []string      `json:"server_names,omitempty"`
+	State             backend.State `json:"state"`
+	Healthy           bool          `json:"healthy"`
+	LastError         string        `json:"last_error,omitempty"`
+	EjectedUntil      *time.Time    `json:"ejected_until,omitempty"`
+	ActiveConnections int64         `json:"active_connections"`
+}
+
+type connectionsStatus struct {
+	Frontend    string                    `json:"frontend"`
+	Connections []frontend.ConnectionInfo `json:"connections"`
+}
+
+type stateRequest struct {
+	State string `json:"state"`
+}
+
+func newBackendStatus(be *backend.Backend) backendStatus {
+	st := backendStatus{
+		Address:           be.Addr,
+		Network:           be.Network,
+		Weight:            be.Weight,
+		ServerNames:       be.ServerNames,
+		State:             be.State(),
+		Healthy:           be.IsHealthy(),
+		ActiveConnections: be.ActiveConns(),
+	}
+	if err := be.LastError(); err != nil {
+		st.LastError = err.Error()
+	}
+	if be.IsEjected() {
+		st.EjectedUntil = new(be.EjectedUntil())
+	}
+	return st
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /frontends", a.listFrontends)
+	mux.HandleFunc("GET /connections", a.listConnections)
+	mux.HandleFunc("PUT /backends/{address}/state", a.setBackendState)
+	return mux
+}
+
+// sortedFrontends returns the running frontends sorted by name.
+func (a *adminServer) sortedFrontends() []*frontend.Frontend {
+	fes := a.frontends()
+	slices.SortFunc(fes, func(f1, f2 *frontend.Frontend) int {
+		return strings.Compare(f1.Name(), f2.Name())
+	})
+	return fes
+}
+
+func (a *adminServer) listFrontends(w http.ResponseWriter, _ *http.Request) {
+	fes := a.sortedFrontends()
+	res := make([]frontendStatus, 0, len(fes))
+	for _, fe := range fes {
+		st := frontendStatus{
+			Name:              fe.Name(),
+			Network:           fe.BindNetwork,
+			Address:           frontend.HostPort{Host: fe.BindHost, Port: fe.BindPort}.String(),
+			ActiveConnections: len(fe.Connections()),
+			Backends:          []backendStatus{},
+		}
+		for _, be := range fe.ListBackends() {
+			st.Backends = append(st.Backends, newBackendStatus(be))
+		}
+		res = append(res, st)
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+func (a *adminServer) listConnections(w http.ResponseWriter, _ *http.Request) {
+	fes := a.sortedFrontends()
+	res := make([]connectionsStatus, 0, len(fes))
+	for _, fe := range fes {
+		res = append(res, connectionsStatus{Frontend: fe.Name(), Connections: fe.Connections()})
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+// setBackendState changes the state of all backends with the given address. The optional "frontend" query parameter
+// restricts the change to the backends of the frontend with that name.
+func (a *adminServer) setBackendState(w http.ResponseWriter, r *http.Request) {
+	var req stateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeError(w, http.StatusBadRequest, errors.New("request body must be a JSON object with a state field"))
+		return
+	}
+	state, err := backend.ParseState(req.State)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	addr, feName := r.PathValue("address"), r.URL.Query().Get("frontend")
+	res := []backendStatus{}
+	for _, fe := range a.sortedFrontends() {
+		if feName != "" && fe.Name() != feName {
+			continue
+		}
+		for _, be := range fe.ListBackends() {
+			if be.Addr != addr {
+				continue
+			}
+			be.SetState(state)
+			a.log.Info("changed backend state", "frontend", fe.Name(), "backend", be.Addr, "state", state)
+			st := newBackendStatus(be)
+			st.Frontend = fe.Name()
+			res = append(res, st)
+		}
+	}
+	if len(res) == 0 {
+		a.writeError(w, http.StatusNotFound, errors.New("no matching backend found"))
+		return
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+func (a *adminServer) writeError(w http.ResponseWriter, code int, err error) {
+	a.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (a *adminServer) writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.log.Error(err, "failed writing response")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/config"
+)
+
+func TestAdminAPIChangesBackendState(t *testing.T) {
+	t.Parallel()
+
+	bind := freePort(t)
+	p := NewL4Proxy(config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{{
+			Bind:           bind,
+			HealthInterval: 60,
+			Backends: []config.Backend{
+				{Address: "127.0.0.1:1"},
+				{Address: "127.0.0.1:2"},
+			},
+		}},
+	}, logr.Discard(), nil, nil)
+	p.Start()
+	t.Cleanup(p.Stop)
+
+	admin := &adminServer{log: logr.Discard(), frontends: p.Frontends}
+	h := admin.handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/backends/127.0.0.1:1/state?frontend="+url.QueryEscape("tcp4/"+bind),
+		strings.NewReader(`{"state":"drain"}`)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/frontends", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var fes []frontendStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &fes))
+	require.Len(t, fes, 1)
+	require.Equal(t, "tcp4/"+bind, fes[0].Name)
+	states := make(map[string]backend.State)
+	for _, be := range fes[0].Backends {
+		states[be.Address] = be.State
+	}
+	require.Equal(t, map[string]backend.State{
+		"127.0.0.1:1": backend.StateDrain,
+		"127.0.0.1:2": backend.StateReady,
+	}, states)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/backends/127.0.0.1:1/state", strings.NewReader(`{"state":"sleeping"}`)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/backends/127.0.0.1:3/state", strings.NewReader(`{"state":"ready"}`)))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
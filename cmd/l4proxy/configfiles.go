@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+
+	"github.com/makkes/l4proxy/config"
+)
+
+// configUpdate requests reloading the configuration files.
+type configUpdate struct {
+	// file is the file that changed or, for updates not caused by a change, the first configuration path.
+	file string
+	// force makes the configuration be reconciled even if it hasn't changed, e.g. for retrying to start frontends and
+	// backends that failed before.
+	force bool
+}
+
+// reloadConfig loads the configuration files for each update received on updates and reconciles the proxy with the
+// merged configuration. Unless the update is forced, the proxy is only reconciled if the parsed configuration changed
+// so that changes of comments or formatting don't cause a reload. It returns when updates is closed.
+func reloadConfig(updates <-chan configUpdate, paths []string, proxy *L4Proxy, log logr.Logger) {
+	var applied *config.Config
+	for update := range updates {
+		log.V(2).Info("config file update, reloading configuration", "config_file", update.file, "forced", update.force)
+		cfg, err := loadConfig(paths)
+		if err != nil {
+			log.Error(err, "failed loading configuration, keeping the current one")
+			continue
+		}
+		if !update.force && applied != nil && reflect.DeepEqual(*cfg, *applied) {
+			log.V(2).Info("configuration unchanged, skipping reconciliation", "config_file", update.file)
+			continue
+		}
+		log.Info("reconciling proxy")
+		proxy.Reconcile(*cfg)
+		applied = cfg
+	}
+}
+
+// configFiles expands the configuration paths given on the command line into files, see expandConfigPath. Files are
+// returned in the order of the paths and only once.
+func configFiles(paths []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		expanded, err := expandConfigPath(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range expanded {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// expandConfigPath expands a directory to the *.yaml and *.yml files in it, like a conf.d directory, and a glob
+// pattern to the files matching it, both sorted by name. Paths of files are returned as is, even if the files don't
+// exist.
+func expandConfigPath(path string) ([]string, error) {
+	var patterns []string
+	switch fi, err := os.Stat(path); {
+	case err == nil && fi.IsDir():
+		patterns = []string{filepath.Join(path, "*.yaml"), filepath.Join(path, "*.yml")}
+	case strings.ContainsAny(path, "*?["):
+		patterns = []string{path}
+	default:
+		return []string{path}, nil
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config path %q: %w", path, err)
+		}
+		for _, match := range matches {
+			if fi, err := os.Stat(match); err == nil && !fi.IsDir() {
+				files = append(files, match)
+			}
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// loadConfig reads and validates all configuration files and merges them into a single configuration, see
+// [config.Merge]. An error is returned if any of the files is invalid so that a partial configuration is never
+// applied.
+func loadConfig(paths []string) (*config.Config, error) {
+	files, err := configFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no configuration files found")
+	}
+	cfgs, err := readConfigFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.Merge(cfgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed merging configuration files: %w", err)
+	}
+	return cfg, nil
+}
+
+// readConfigFiles reads and validates the given files. It returns the errors of all invalid files.
+func readConfigFiles(files []string) ([]*config.Config, error) {
+	cfgs := make([]*config.Config, 0, len(files))
+	var errs []error
+	for _, file := range files {
+		cfg, err := config.Read(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := cfg.Validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, errors.Join(errs...)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/config"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestConfigFilesExpandsDirectoriesAndPatterns(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, name := range []string{"conf.d/b.yaml", "conf.d/a.yml", "conf.d/notes.txt", "other/x.yaml", "main.yaml"} {
+		writeFile(t, filepath.Join(dir, name), "")
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "conf.d", "sub.yaml"), 0o700))
+
+	files, err := configFiles([]string{
+		filepath.Join(dir, "main.yaml"),
+		filepath.Join(dir, "conf.d"),
+		filepath.Join(dir, "*", "*.yaml"),
+		filepath.Join(dir, "missing.yaml"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "main.yaml"),
+		filepath.Join(dir, "conf.d", "a.yml"),
+		filepath.Join(dir, "conf.d", "b.yaml"),
+		filepath.Join(dir, "other", "x.yaml"),
+		filepath.Join(dir, "missing.yaml"),
+	}, files)
+}
+
+func TestLoadConfigMergesFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "announced.yaml"), `apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:80
+`)
+	writeFile(t, filepath.Join(dir, "conf.d", "static.yaml"), `apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.101:80
+`)
+
+	cfg, err := loadConfig([]string{filepath.Join(dir, "announced.yaml"), filepath.Join(dir, "conf.d")})
+	require.NoError(t, err)
+	require.Len(t, cfg.Frontends, 1)
+	require.Equal(t, []config.Backend{{Address: "10.0.0.100:80"}, {Address: "10.0.0.101:80"}}, cfg.Frontends[0].Backends)
+
+	writeFile(t, filepath.Join(dir, "conf.d", "static.yaml"), `apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 10
+    backends:
+      - address: 10.0.0.101:80
+`)
+	_, err = loadConfig([]string{filepath.Join(dir, "announced.yaml"), filepath.Join(dir, "conf.d")})
+	require.ErrorContains(t, err, filepath.Join(dir, "conf.d", "static.yaml")+":3: frontends[0]: frontend tcp4/:80 "+
+		"conflicts with the one defined in "+filepath.Join(dir, "announced.yaml")+":3")
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "empty.d"), 0o700))
+	_, err = loadConfig([]string{filepath.Join(dir, "empty.d")})
+	require.EqualError(t, err, "no configuration files found")
+}
+
+func TestForcedReloadRetriesFailedFrontends(t *testing.T) {
+	t.Parallel()
+
+	// the frontend fails to start as long as its address is in use.
+	occupied, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "l4proxy.yaml")
+	writeFile(t, path, "apiVersion: v1\nfrontends:\n  - bind: "+occupied.Addr().String()+"\n    healthInterval: 60\n")
+
+	p := NewL4Proxy(config.Config{}, logr.Discard(), nil, nil)
+	t.Cleanup(p.Stop)
+	updates := make(chan configUpdate)
+	t.Cleanup(func() { close(updates) })
+	go reloadConfig(updates, []string{path}, p, logr.Discard())
+
+	// reloadConfig has finished processing an update once it receives the next one.
+	update := func(u configUpdate) {
+		updates <- u
+		updates <- configUpdate{file: path}
+	}
+
+	update(configUpdate{file: path})
+	require.Empty(t, p.Frontends())
+	require.NoError(t, occupied.Close())
+
+	// unchanged files don't cause a reconciliation unless it is forced, like on SIGHUP.
+	update(configUpdate{file: path})
+	require.Empty(t, p.Frontends())
+	update(configUpdate{file: path, force: true})
+	require.Len(t, p.Frontends(), 1)
+}
@@ -2,80 +2,40 @@
 package main
 
 import (
+	"context"
 	goflag "flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-logr/glogr"
-	"github.com/go-logr/logr"
 	flag "github.com/spf13/pflag"
 
 	"github.com/makkes/l4proxy/config"
-	"github.com/makkes/l4proxy/frontend"
+	"github.com/makkes/l4proxy/metrics"
 )
 
-type L4Proxy struct {
-	cfg       config.Config
-	log       logr.Logger
-	frontends []*frontend.Frontend
-}
-
-func NewL4Proxy(cfg config.Config, log logr.Logger) L4Proxy {
-	return L4Proxy{
-		cfg: cfg,
-		log: log,
-	}
-}
-
-func (p *L4Proxy) Start() {
-	frontends := make([]*frontend.Frontend, 0, len(p.cfg.Frontends))
-	for _, feCfg := range p.cfg.Frontends {
-		fe, err := frontend.NewFrontend("tcp", feCfg.Bind, p.log,
-			frontend.WithTimeout(feCfg.Timeout),
-		)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error creating frontend: %s\n", err.Error())
-			os.Exit(1) //revive:disable:deep-exit // TODO: refactor
-		}
-		for _, beCfg := range feCfg.Backends {
-			if err := fe.AddBackend(beCfg.Address, feCfg.HealthInterval); err != nil {
-				p.log.Error(err, "error adding backend", "backend", beCfg, "frontend", feCfg)
-			}
-		}
-		frontends = append(frontends, &fe)
-	}
-
-	var lastErr error
-
-	for _, fe := range frontends {
-		if err := fe.Start(); err != nil {
-			lastErr = err
-			p.log.Error(err, "failed to start frontend", "host", fe.BindHost, "port", fe.BindPort)
-		}
-	}
-
-	p.frontends = frontends
-
-	if lastErr == nil {
-		p.log.Info("all frontends running")
-		return
-	}
-
-	p.log.Info("some frontends failed to start")
-}
-
-func (p *L4Proxy) Stop() {
-	for _, fe := range p.frontends {
-		fe.Stop()
-	}
-}
-
 //nolint:gocognit // TODO: reduce cognitive complexity
 //revive:disable:cyclomatic // TODO: reduce cognitive complexity
 func main() {
-	var configFiles []string
-	flag.StringSliceVarP(&configFiles, "config", "c", nil, "configuration files")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	var configPaths []string
+	flag.StringSliceVarP(&configPaths, "config", "c", nil,
+		"configuration files, directories containing *.yaml and *.yml files or glob patterns. All files are merged.")
+	var metricsAddr string
+	flag.StringVar(&metricsAddr, "metrics-bind-address", "",
+		"address to serve Prometheus metrics on at /metrics, e.g. ':9090'. Metrics are disabled if empty.")
+	var adminAddr string
+	flag.StringVar(&adminAddr, "admin-bind-address", "",
+		"address to serve the admin API on, e.g. '127.0.0.1:9091'. The admin API is disabled if empty.")
+	var shutdownGracePeriod time.Duration
+	flag.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", defaultShutdownGracePeriod,
+		"time connections are given to finish on SIGTERM or SIGINT before they are closed. A second signal exits immediately.")
 
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	if err := flag.Set("v", "1"); err != nil {
@@ -88,60 +48,63 @@ func main() {
 	}
 	flag.Parse()
 
-	if len(configFiles) == 0 {
+	if len(configPaths) == 0 {
 		fmt.Fprintln(os.Stderr, "no config file provided, exiting.")
 		os.Exit(1)
 	}
 
 	log := glogr.New()
 
-	cfgFileUpdateCh := make(chan string)
-
-	go func(cfgFileUpdateCh <-chan string) {
-		proxies := make(map[string]*L4Proxy)
-		for configFile := range cfgFileUpdateCh {
-			cfgFileLog := log.WithValues("config_file", configFile)
-			cfgFileLog.V(2).Info("config file update, reloading configuration")
-			cfg, err := config.Read(configFile)
-			if err != nil {
-				cfgFileLog.Error(err, "could not read config file")
-				continue
-			}
-			p := proxies[configFile]
-			if p != nil {
-				cfgFileLog.Info("restarting proxy")
-				p.Stop()
-			} else {
-				cfgFileLog.Info("starting proxy")
-			}
-			newProxy := NewL4Proxy(*cfg, cfgFileLog)
-			proxies[configFile] = &newProxy
-			newProxy.Start()
+	var m *metrics.Metrics
+	if metricsAddr != "" {
+		var err error
+		m, err = serveMetrics(metricsAddr, log)
+		if err != nil {
+			log.Error(err, "failed serving metrics")
+			os.Exit(1)
+		}
+	}
+
+	// signals are handled once the proxy is running but are registered early so that none gets lost.
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	logs := newAccessLogs()
+
+	// all configuration files are merged into a single configuration run by a single proxy.
+	proxy := NewL4Proxy(config.Config{}, log, m, logs)
+
+	if adminAddr != "" {
+		admin := &adminServer{
+			log:       log.WithName("admin"),
+			frontends: proxy.Frontends,
+		}
+		if err := serveHTTP(adminAddr, admin.handler(), log.WithName("admin")); err != nil {
+			log.Error(err, "failed serving admin API")
+			os.Exit(1)
 		}
-	}(cfgFileUpdateCh)
-
-	for _, configFile := range configFiles {
-		cfgFileUpdateCh <- configFile // initial message to start all proxies
-		cfgFileLog := log.WithValues("config_file", configFile)
-		go func(updateCh chan<- string, configFile string, log logr.Logger) {
-			var lastModTime time.Time
-			ticker := time.NewTicker(3 * time.Second)
-			for range ticker.C {
-				cfgFile, err := os.Stat(configFile)
-				if err != nil {
-					log.Error(err, "failed to stat configuration file for modification checking")
-					continue
-				}
-				if cfgFile.ModTime().After(lastModTime) {
-					if !lastModTime.IsZero() {
-						updateCh <- configFile
-					}
-					lastModTime = cfgFile.ModTime()
-				}
-			}
-		}(cfgFileUpdateCh, configFile, cfgFileLog)
 	}
 
-	ch := make(chan struct{})
-	<-ch
+	cfgFileUpdateCh := make(chan configUpdate)
+	go reloadConfig(cfgFileUpdateCh, configPaths, proxy, log)
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go watchConfig(watchCtx, configPaths, cfgFileUpdateCh, log)
+	cfgFileUpdateCh <- configUpdate{file: configPaths[0]} // initial message to start the proxy
+
+	// SIGHUP re-reads all configuration files and reopens the access log files so that they can be rotated externally.
+	// The reload is forced so that frontends and backends that failed to start are retried.
+	reload := func() {
+		if err := logs.reopen(); err != nil {
+			log.Error(err, "failed reopening access logs")
+		}
+		cfgFileUpdateCh <- configUpdate{file: configPaths[0], force: true}
+	}
+	shutdown := func() {
+		stopWatching()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		proxy.Shutdown(ctx)
+	}
+	os.Exit(handleSignals(sigCh, reload, shutdown, log))
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/makkes/l4proxy/metrics"
+)
+
+// serveMetrics creates the proxy's metrics and serves them at /metrics on the given address in the background.
+func serveMetrics(addr string, log logr.Logger) (*metrics.Metrics, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	m, err := metrics.New(reg)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	if err := serveHTTP(addr, mux, log.WithName("metrics")); err != nil {
+		return nil, fmt.Errorf("failed serving metrics: %w", err)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+
+	"github.com/go-logr/logr"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/config"
+	"github.com/makkes/l4proxy/frontend"
+	"github.com/makkes/l4proxy/metrics"
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+// L4Proxy runs the frontends of a configuration.
+type L4Proxy struct {
+	cfg     config.Config
+	log     logr.Logger
+	metrics *metrics.Metrics
+	// accessLogs holds the frontends' access logs, which may be shared with other proxies.
+	accessLogs *accessLogs
+	// mux guards frontends.
+	mux       sync.Mutex
+	frontends map[frontendKey]*runningFrontend
+	// stopped is set once the proxy has been stopped, after which configurations aren't applied anymore. It's guarded
+	// by mux.
+	stopped bool
+	// draining tracks frontends that have been removed from the configuration and are still draining connections.
+	draining sync.WaitGroup
+}
+
+// frontendKey identifies a frontend across configuration changes. Frontends with the same key share the same
+// listener so changing anything but the key can be applied without closing the listener.
+type frontendKey struct {
+	network string
+	bind    string
+}
+
+type runningFrontend struct {
+	cfg config.Frontend
+	fe  *frontend.Frontend
+	// failedBackends holds the addresses of the configured backends that couldn't be added or replaced. They are
+	// retried on each reconciliation, even if the configuration didn't change.
+	failedBackends map[string]bool
+}
+
+// NewL4Proxy creates a proxy for the given configuration. The frontends record their metrics in m which may be nil.
+// Access log files are opened through logs so that proxies can share them; if logs is nil, the proxy uses its own.
+func NewL4Proxy(cfg config.Config, log logr.Logger, m *metrics.Metrics, logs *accessLogs) *L4Proxy {
+	if logs == nil {
+		logs = newAccessLogs()
+	}
+	return &L4Proxy{
+		cfg:        cfg,
+		log:        log,
+		metrics:    m,
+		accessLogs: logs,
+		frontends:  make(map[frontendKey]*runningFrontend),
+	}
+}
+
+// Start starts all frontends of the proxy's configuration.
+func (p *L4Proxy) Start() {
+	p.Reconcile(p.cfg)
+}
+
+// Stop stops all frontends, draining their connections. It returns when all frontends have been stopped. Later calls
+// to Reconcile are ignored.
+func (p *L4Proxy) Stop() {
+	p.mux.Lock()
+	p.stopped = true
+	for key, rf := range p.frontends {
+		p.drain(rf)
+		delete(p.frontends, key)
+	}
+	p.mux.Unlock()
+	p.draining.Wait()
+}
+
+// Shutdown is like Stop but drains the connections of all frontends until ctx is done instead of using their drain
+// timeouts. All frontends stop accepting connections before any of them is drained. Frontends that have been removed
+// from the configuration before keep draining until their drain timeout.
+func (p *L4Proxy) Shutdown(ctx context.Context) {
+	p.mux.Lock()
+	p.stopped = true
+	for _, rf := range p.frontends {
+		rf.fe.Close()
+	}
+	for key, rf := range p.frontends {
+		p.draining.Go(func() {
+			rf.fe.Shutdown(ctx)
+			p.releaseAccessLog(rf.cfg.AccessLog)
+		})
+		delete(p.frontends, key)
+	}
+	p.mux.Unlock()
+	p.draining.Wait()
+}
+
+// Frontends returns the running frontends.
+func (p *L4Proxy) Frontends() []*frontend.Frontend {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	fes := make([]*frontend.Frontend, 0, len(p.frontends))
+	for _, rf := range p.frontends {
+		fes = append(fes, rf.fe)
+	}
+	return fes
+}
+
+// drain stops accepting connections on the given frontend and stops it in the background once its connections have
+// been drained. Its access log is released afterwards.
+func (p *L4Proxy) drain(rf *runningFrontend) {
+	rf.fe.Close()
+	p.draining.Go(func() {
+		rf.fe.Stop()
+		p.releaseAccessLog(rf.cfg.AccessLog)
+	})
+}
+
+func (p *L4Proxy) releaseAccessLog(cfg *config.AccessLog) {
+	if err := p.accessLogs.release(cfg); err != nil {
+		p.log.Error(err, "failed releasing access log")
+	}
+}
+
+// Reconcile changes the running frontends so that they match the given configuration. Frontends that are not part of
+// the configuration anymore are stopped and new frontends are started. Frontends that are part of both the old and
+// the new configuration keep their listener and live connections; their settings are updated and backends are added
+// or removed individually so that unchanged backends keep their health state.
+func (p *L4Proxy) Reconcile(cfg config.Config) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.stopped {
+		p.log.V(2).Info("proxy has been stopped, ignoring configuration")
+		return
+	}
+
+	wanted := make(map[frontendKey]config.Frontend, len(cfg.Frontends))
+	for _, feCfg := range cfg.Frontends {
+		network, err := frontend.Network(feCfg.Protocol, feCfg.Family)
+		if err != nil {
+			p.log.Error(err, "error creating frontend", "frontend", feCfg.Bind)
+			continue
+		}
+		key := frontendKey{network: network, bind: feCfg.Bind}
+		if _, ok := wanted[key]; ok {
+			p.log.Error(nil, "ignoring duplicate frontend", "network", network, "frontend", feCfg.Bind)
+			continue
+		}
+		// the global defaults are applied here so that changing them updates the frontends using them.
+		if feCfg.Allow == nil {
+			feCfg.Allow = cfg.Allow
+		}
+		if feCfg.Deny == nil {
+			feCfg.Deny = cfg.Deny
+		}
+		wanted[key] = feCfg
+	}
+
+	for key, rf := range p.frontends {
+		if _, ok := wanted[key]; !ok {
+			p.log.Info("stopping frontend", "network", key.network, "frontend", key.bind)
+			p.drain(rf)
+			delete(p.frontends, key)
+		}
+	}
+
+	var failed bool
+	for key, feCfg := range wanted {
+		if rf, ok := p.frontends[key]; ok {
+			if err := p.updateFrontend(rf, feCfg); err != nil {
+				failed = true
+				p.log.Error(err, "failed to update frontend", "network", key.network, "frontend", key.bind)
+			}
+			continue
+		}
+		rf, err := p.startFrontend(key, feCfg)
+		if err != nil {
+			failed = true
+			p.log.Error(err, "failed to start frontend", "network", key.network, "frontend", key.bind)
+			continue
+		}
+		p.frontends[key] = rf
+	}
+
+	p.cfg = cfg
+
+	if !failed {
+		p.log.Info("all frontends running")
+		return
+	}
+
+	p.log.Info("some frontends failed to start")
+}
+
+func (p *L4Proxy) startFrontend(key frontendKey, feCfg config.Frontend) (*runningFrontend, error) {
+	balancer, err := frontend.NewBalancer(feCfg.Balance)
+	if err != nil {
+		return nil, fmt.Errorf("error creating balancer: %w", err)
+	}
+	opts, err := frontendOptions(feCfg, p.log)
+	if err != nil {
+		return nil, err
+	}
+	accessLog, err := p.accessLogs.acquire(feCfg.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, frontend.WithBalancer(balancer), frontend.WithMetrics(p.metrics), frontend.WithAccessLog(accessLog))
+	fe, err := frontend.NewFrontend(key.network, key.bind, p.log, opts...)
+	if err != nil {
+		p.releaseAccessLog(feCfg.AccessLog)
+		return nil, fmt.Errorf("error creating frontend: %w", err)
+	}
+	failedBackends := make(map[string]bool)
+	for _, beCfg := range feCfg.Backends {
+		if err := p.addBackend(fe, feCfg, beCfg); err != nil {
+			failedBackends[beCfg.Address] = true
+			p.log.Error(err, "error adding backend", "backend", beCfg, "frontend", feCfg)
+		}
+	}
+	if err := fe.Start(); err != nil {
+		fe.Stop()
+		p.releaseAccessLog(feCfg.AccessLog)
+		return nil, fmt.Errorf("failed to start frontend on %s: %w", key.bind, err)
+	}
+	return &runningFrontend{cfg: feCfg, fe: fe, failedBackends: failedBackends}, nil
+}
+
+func (p *L4Proxy) updateFrontend(rf *runningFrontend, feCfg config.Frontend) error {
+	if reflect.DeepEqual(rf.cfg, feCfg) {
+		if len(rf.failedBackends) > 0 {
+			p.log.Info("retrying failed backends", "frontend", feCfg.Bind)
+			p.updateBackends(rf, feCfg)
+		}
+		return nil
+	}
+	p.log.Info("updating frontend", "frontend", feCfg.Bind)
+
+	if feCfg.AcceptProxyProtocol && rf.fe.Protocol() != frontend.ProtocolTCP {
+		return errors.New("the PROXY protocol is only supported for TCP")
+	}
+	if feCfg.SNIRouting && rf.fe.Protocol() != frontend.ProtocolTCP {
+		return errors.New("SNI routing is only supported for TCP")
+	}
+	if feCfg.TLS != nil && rf.fe.Protocol() != frontend.ProtocolTCP {
+		return errors.New("TLS termination is only supported for TCP")
+	}
+	opts, err := frontendOptions(feCfg, p.log)
+	if err != nil {
+		return err
+	}
+	// the balancer is only replaced when the strategy changes so that it keeps its state otherwise.
+	if rf.cfg.Balance != feCfg.Balance {
+		balancer, err := frontend.NewBalancer(feCfg.Balance)
+		if err != nil {
+			return fmt.Errorf("error creating balancer: %w", err)
+		}
+		opts = append(opts, frontend.WithBalancer(balancer))
+	}
+	// the new access log is acquired before the old one is released so that a file used by both stays open.
+	accessLog, err := p.accessLogs.acquire(feCfg.AccessLog)
+	if err != nil {
+		return err
+	}
+	rf.fe.Update(append(opts, frontend.WithAccessLog(accessLog))...)
+	p.releaseAccessLog(rf.cfg.AccessLog)
+
+	p.updateBackends(rf, feCfg)
+	rf.cfg = feCfg
+
+	return nil
+}
+
+// updateBackends adds, removes and replaces the running frontend's backends according to the new configuration.
+// Backends whose configuration didn't change are kept unless they failed to be added or replaced before.
+func (p *L4Proxy) updateBackends(rf *runningFrontend, feCfg config.Frontend) {
+	oldBackends := make(map[string]config.Backend, len(rf.cfg.Backends))
+	for _, beCfg := range rf.cfg.Backends {
+		oldBackends[beCfg.Address] = beCfg
+	}
+	newBackends := make(map[string]config.Backend, len(feCfg.Backends))
+	for _, beCfg := range feCfg.Backends {
+		newBackends[beCfg.Address] = beCfg
+	}
+
+	for addr := range oldBackends {
+		if _, ok := newBackends[addr]; ok {
+			continue
+		}
+		p.log.V(2).Info("removing backend", "frontend", feCfg.Bind, "backend", addr)
+		delete(rf.failedBackends, addr)
+		if _, err := rf.fe.RemoveBackend(addr); err != nil {
+			p.log.Error(err, "error removing backend", "backend", addr, "frontend", feCfg.Bind)
+		}
+	}
+	// backends are replaced if their configuration or the frontend's defaults for backends changed. Replaced backends
+	// keep their health so that they keep receiving connections.
+	defaultsChanged := backendDefaultsChanged(rf.cfg, feCfg)
+	for addr, newCfg := range newBackends {
+		oldCfg, ok := oldBackends[addr]
+		var err error
+		switch {
+		case !ok:
+			p.log.V(2).Info("adding backend", "frontend", feCfg.Bind, "backend", addr)
+			err = p.addBackend(rf.fe, feCfg, newCfg)
+		case rf.failedBackends[addr] || defaultsChanged || !reflect.DeepEqual(oldCfg, newCfg):
+			// a backend that failed to be added before is added by replacing it.
+			p.log.V(2).Info("replacing backend", "frontend", feCfg.Bind, "backend", addr)
+			err = p.replaceBackend(rf.fe, feCfg, newCfg)
+		default:
+			continue
+		}
+		if err != nil {
+			rf.failedBackends[addr] = true
+			p.log.Error(err, "error updating backend", "backend", newCfg, "frontend", feCfg)
+			continue
+		}
+		delete(rf.failedBackends, addr)
+	}
+}
+
+// frontendOptions returns the options for configuring a frontend from the given configuration. The balancer is not
+// part of the options so that it can be kept across configuration changes.
+func frontendOptions(feCfg config.Frontend, log logr.Logger) ([]frontend.Option, error) {
+	trustedProxies, err := parsePrefixes(feCfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trustedProxies setting: %w", err)
+	}
+	allow, err := parsePrefixes(feCfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow setting: %w", err)
+	}
+	deny, err := parsePrefixes(feCfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny setting: %w", err)
+	}
+	var limits frontend.Limits
+	if l := feCfg.Limits; l != nil {
+		limits = frontend.Limits{
+			MaxConnections:          l.MaxConnections,
+			QueueTimeout:            l.QueueTimeout,
+			MaxConnectionsPerSource: l.MaxConnectionsPerSource,
+			RatePerSource:           l.RatePerSource,
+			BurstPerSource:          l.BurstPerSource,
+		}
+	}
+	var tlsCfg *tls.Config
+	if feCfg.TLS != nil {
+		tlsCfg, err = serverTLSConfig(feCfg.TLS, log.WithValues("frontend", feCfg.Bind))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls setting: %w", err)
+		}
+	}
+	retries := frontend.DefaultRetries
+	if feCfg.Retries != nil {
+		retries = *feCfg.Retries
+	}
+	idleTimeout := feCfg.Timeout
+	if feCfg.IdleTimeout != 0 {
+		idleTimeout = feCfg.IdleTimeout
+	}
+	return []frontend.Option{
+		frontend.WithTimeout(idleTimeout),
+		frontend.WithClientIdleTimeout(feCfg.ClientIdleTimeout),
+		frontend.WithBackendIdleTimeout(feCfg.BackendIdleTimeout),
+		frontend.WithMaxConnectionLifetime(feCfg.MaxConnectionLifetime),
+		frontend.WithDrainTimeout(feCfg.DrainTimeout),
+		frontend.WithAcceptProxyProtocol(feCfg.AcceptProxyProtocol),
+		frontend.WithTrustedProxies(trustedProxies),
+		frontend.WithAllowedSources(allow),
+		frontend.WithDeniedSources(deny),
+		frontend.WithRetries(retries),
+		frontend.WithSNIRouting(feCfg.SNIRouting),
+		frontend.WithTLS(tlsCfg),
+		frontend.WithLimits(limits),
+	}, nil
+}
+
+// parsePrefixes parses a list of IP addresses and CIDR networks. IP addresses are converted to single-address
+// networks.
+func parsePrefixes(specs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(specs))
+	for _, spec := range specs {
+		if addr, err := netip.ParseAddr(spec); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR network: %w", spec, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (*L4Proxy) addBackend(fe *frontend.Frontend, feCfg config.Frontend, beCfg config.Backend) error {
+	opts, err := backendOptions(feCfg, beCfg)
+	if err != nil {
+		return err
+	}
+	return fe.AddBackend(beCfg.Address, feCfg.HealthInterval, opts...)
+}
+
+func (*L4Proxy) replaceBackend(fe *frontend.Frontend, feCfg config.Frontend, beCfg config.Backend) error {
+	opts, err := backendOptions(feCfg, beCfg)
+	if err != nil {
+		return err
+	}
+	return fe.ReplaceBackend(beCfg.Address, feCfg.HealthInterval, opts...)
+}
+
+// backendDefaultsChanged reports whether any of the frontend settings that apply to all of its backends differ
+// between the two configurations.
+func backendDefaultsChanged(oldCfg, newCfg config.Frontend) bool {
+	return oldCfg.HealthInterval != newCfg.HealthInterval ||
+		oldCfg.SendProxyProtocol != newCfg.SendProxyProtocol ||
+		oldCfg.ConnectTimeout != newCfg.ConnectTimeout ||
+		!reflect.DeepEqual(oldCfg.HealthCheck, newCfg.HealthCheck) ||
+		!reflect.DeepEqual(oldCfg.BackendTLS, newCfg.BackendTLS) ||
+		!reflect.DeepEqual(oldCfg.OutlierDetection, newCfg.OutlierDetection)
+}
+
+// backendOptions returns the options for creating a backend from the given configuration. Backend settings take
+// precedence over the frontend's defaults.
+func backendOptions(feCfg config.Frontend, beCfg config.Backend) ([]backend.Option, error) {
+	sendProxyProtocol := beCfg.SendProxyProtocol
+	if sendProxyProtocol == "" {
+		sendProxyProtocol = feCfg.SendProxyProtocol
+	}
+	ppVersion, err := proxyproto.ParseVersion(sendProxyProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sendProxyProtocol setting: %w", err)
+	}
+	if len(beCfg.ServerNames) > 0 && !feCfg.SNIRouting {
+		return nil, errors.New("serverNames are only supported on frontends with sniRouting enabled")
+	}
+
+	opts := []backend.Option{
+		backend.WithWeight(beCfg.Weight),
+		backend.WithProxyProtocol(ppVersion),
+		backend.WithConnectTimeout(feCfg.ConnectTimeout),
+		backend.WithServerNames(beCfg.ServerNames...),
+		backend.WithMaxConnections(beCfg.MaxConnections),
+	}
+
+	// the backend's health check takes precedence over the frontend's default.
+	hc := beCfg.HealthCheck
+	if hc == nil {
+		hc = feCfg.HealthCheck
+	}
+	if hc != nil {
+		checker, err := healthChecker(hc, feCfg.Protocol)
+		if err != nil {
+			return nil, fmt.Errorf("invalid healthCheck setting: %w", err)
+		}
+		opts = append(opts,
+			backend.WithHealthChecker(checker),
+			backend.WithHealthThresholds(hc.Rise, hc.Fall),
+			backend.WithHealthCheckTimeout(hc.Timeout),
+			backend.WithHealthCheckJitter(hc.Jitter),
+		)
+	}
+
+	// the backend's TLS settings take precedence over the frontend's default.
+	backendTLS := beCfg.TLS
+	if backendTLS == nil {
+		backendTLS = feCfg.BackendTLS
+	}
+	if backendTLS != nil {
+		if feCfg.Protocol == frontend.ProtocolUDP {
+			return nil, errors.New("TLS is not supported for UDP backends")
+		}
+		tlsCfg, err := backendTLSConfig(backendTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls setting: %w", err)
+		}
+		opts = append(opts, backend.WithTLS(tlsCfg))
+	}
+
+	if od := feCfg.OutlierDetection; od != nil {
+		opts = append(opts, backend.WithOutlierDetection(backend.OutlierDetection{
+			ConsecutiveFailures: od.ConsecutiveFailures,
+			BaseEjectionTime:    od.BaseEjectionTime,
+			MaxEjectionTime:     od.MaxEjectionTime,
+			FirstByteTimeout:    od.FirstByteTimeout,
+		}))
+	}
+
+	return opts, nil
+}
+
+// healthChecker returns the health check for a backend of a frontend with the given protocol.
+func healthChecker(hc *config.HealthCheck, protocol string) (backend.HealthChecker, error) {
+	if hc.Type != "" && hc.Type != config.HealthCheckTCP && protocol == frontend.ProtocolUDP {
+		return nil, fmt.Errorf("type %q is not supported for UDP", hc.Type)
+	}
+
+	tlsCfg := &tls.Config{ //nolint:gosec // skipping verification is an explicit choice of the user.
+		InsecureSkipVerify: hc.InsecureSkipVerify,
+	}
+	if hc.Host != "" {
+		tlsCfg.ServerName = hc.Host
+		if host, _, err := net.SplitHostPort(hc.Host); err == nil {
+			tlsCfg.ServerName = host
+		}
+	}
+
+	switch hc.Type {
+	case "", config.HealthCheckTCP:
+		return backend.TCPCheck{Send: []byte(hc.Send), Expect: []byte(hc.Expect)}, nil
+	case config.HealthCheckHTTP, config.HealthCheckHTTPS:
+		check := backend.HTTPCheck{
+			Path:         hc.Path,
+			Host:         hc.Host,
+			ExpectStatus: hc.ExpectStatus,
+			ExpectBody:   hc.ExpectBody,
+		}
+		if hc.Type == config.HealthCheckHTTPS {
+			check.TLS = tlsCfg
+		}
+		return check, nil
+	case config.HealthCheckTLS:
+		return backend.TLSCheck{Config: tlsCfg}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected one of %s, %s, %s, %s", hc.Type,
+			config.HealthCheckTCP, config.HealthCheckHTTP, config.HealthCheckHTTPS, config.HealthCheckTLS)
+	}
+}
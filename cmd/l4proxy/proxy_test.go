@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/config"
+	"github.com/makkes/l4proxy/frontend"
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+// TestConfigValuesAreSupported makes sure that the values the config package accepts, which it keeps on its own so
+// that it doesn't depend on the proxy implementation, are supported by the frontends.
+func TestConfigValuesAreSupported(t *testing.T) {
+	t.Parallel()
+
+	for _, balance := range []string{
+		config.BalanceRandom, config.BalanceRoundRobin, config.BalanceWeightedRoundRobin, config.BalanceLeastConnections,
+	} {
+		_, err := frontend.NewBalancer(balance)
+		require.NoError(t, err, "balancing strategy %s", balance)
+	}
+	for _, version := range []string{config.ProxyProtocolV1, config.ProxyProtocolV2} {
+		_, err := proxyproto.ParseVersion(version)
+		require.NoError(t, err, "PROXY protocol version %s", version)
+	}
+}
+
+func TestReconcileKeepsUnchangedFrontendsAndBackends(t *testing.T) {
+	t.Parallel()
+
+	bind1, bind2 := freePort(t), freePort(t)
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{
+			{
+				Bind:           bind1,
+				HealthInterval: 60,
+				Backends: []config.Backend{
+					{Address: "127.0.0.1:1"},
+					{Address: "127.0.0.1:2"},
+				},
+			},
+			{
+				Bind:           bind2,
+				HealthInterval: 60,
+				Backends:       []config.Backend{{Address: "127.0.0.1:3"}},
+			},
+		},
+	}
+
+	p := NewL4Proxy(cfg, logr.Discard(), nil, nil)
+	p.Start()
+	t.Cleanup(p.Stop)
+	require.Len(t, p.frontends, 2)
+
+	fe1 := p.frontends[frontendKey{network: "tcp4", bind: bind1}].fe
+	unchanged := fe1.Backends[0]
+	listenerAddr := fe1.Addr()
+
+	bind3 := freePort(t)
+	newCfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{
+			{
+				Bind:           bind1,
+				HealthInterval: 60,
+				Balance:        "round-robin",
+				Backends: []config.Backend{
+					{Address: "127.0.0.1:1"},
+					{Address: "127.0.0.1:4"},
+				},
+			},
+			{
+				Bind:           bind3,
+				HealthInterval: 60,
+				Backends:       []config.Backend{{Address: "127.0.0.1:3"}},
+			},
+		},
+	}
+	p.Reconcile(newCfg)
+
+	require.Len(t, p.frontends, 2)
+	require.Same(t, fe1, p.frontends[frontendKey{network: "tcp4", bind: bind1}].fe, "frontend should have been kept")
+	require.Equal(t, listenerAddr, fe1.Addr(), "listener should have been kept")
+	require.Len(t, fe1.Backends, 2)
+	require.Same(t, unchanged, fe1.Backends[0], "unchanged backend should have been kept")
+	require.Equal(t, "127.0.0.1:4", fe1.Backends[1].Addr)
+	require.NotContains(t, p.frontends, frontendKey{network: "tcp4", bind: bind2})
+	require.Contains(t, p.frontends, frontendKey{network: "tcp4", bind: bind3})
+
+	// the removed frontend's port must be free again.
+	l, err := net.Listen("tcp4", bind2)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
+
+func TestReconcileReplacesBackendsWhenHealthIntervalChanges(t *testing.T) {
+	t.Parallel()
+
+	backendAddr := startEchoServer(t)
+	bind := freePort(t)
+	feCfg := config.Frontend{
+		Bind:           bind,
+		HealthInterval: 60,
+		Backends:       []config.Backend{{Address: backendAddr}},
+	}
+	p := NewL4Proxy(config.Config{Frontends: []config.Frontend{feCfg}}, logr.Discard(), nil, nil)
+	p.Start()
+	t.Cleanup(p.Stop)
+
+	fe := p.frontends[frontendKey{network: "tcp4", bind: bind}].fe
+	old := fe.Backends[0]
+	require.Eventually(t, old.IsHealthy, 3*time.Second, 10*time.Millisecond)
+	old.SetState(backend.StateDrain)
+
+	feCfg.HealthInterval = 30
+	p.Reconcile(config.Config{Frontends: []config.Frontend{feCfg}})
+
+	require.Len(t, fe.Backends, 1)
+	replaced := fe.Backends[0]
+	require.NotSame(t, old, replaced)
+	require.True(t, replaced.IsHealthy(), "the replaced backend should have kept its health")
+	require.Equal(t, backend.StateDrain, replaced.State(), "the replaced backend should have kept its state")
+
+	replaced.SetState(backend.StateReady)
+	conn, err := net.Dial("tcp4", bind)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+	msg := []byte("hello")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, buf)
+}
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, l.Close())
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					return
+				}
+				require.NoError(t, conn.Close())
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestReconcileRetriesFailedBackends(t *testing.T) {
+	t.Parallel()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	bind := freePort(t)
+	cfg := config.Config{Frontends: []config.Frontend{{
+		Bind:           bind,
+		HealthInterval: 60,
+		Backends: []config.Backend{
+			{Address: "127.0.0.1:1"},
+			{Address: "127.0.0.1:2", TLS: &config.BackendTLS{CAFile: caFile}},
+		},
+	}}}
+	p := NewL4Proxy(cfg, logr.Discard(), nil, nil)
+	p.Start()
+	t.Cleanup(p.Stop)
+
+	fe := p.frontends[frontendKey{network: "tcp4", bind: bind}].fe
+	require.Len(t, fe.ListBackends(), 1, "the backend with a missing CA file should have failed")
+
+	writeCACertificate(t, caFile)
+	p.Reconcile(cfg)
+
+	backends := fe.ListBackends()
+	require.Len(t, backends, 2, "the failed backend should have been retried")
+	require.Equal(t, "127.0.0.1:2", backends[1].Addr)
+}
+
+// writeCACertificate writes a self-signed certificate to path.
+func writeCACertificate(t *testing.T, path string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "l4proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+}
+
+func TestReconcileAppliesGlobalAccessLists(t *testing.T) {
+	t.Parallel()
+
+	bind1, bind2 := freePort(t), freePort(t)
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Deny:       []string{"192.0.2.0/24"},
+		Frontends: []config.Frontend{
+			{Bind: bind1, HealthInterval: 60},
+			{Bind: bind2, HealthInterval: 60, Deny: []string{}},
+		},
+	}
+
+	p := NewL4Proxy(cfg, logr.Discard(), nil, nil)
+	p.Start()
+	t.Cleanup(p.Stop)
+
+	require.Equal(t, []string{"192.0.2.0/24"}, p.frontends[frontendKey{network: "tcp4", bind: bind1}].cfg.Deny)
+	require.Empty(t, p.frontends[frontendKey{network: "tcp4", bind: bind2}].cfg.Deny, "frontend setting should take precedence")
+
+	cfg.Deny = []string{"198.51.100.0/24"}
+	p.Reconcile(cfg)
+	require.Equal(t, []string{"198.51.100.0/24"}, p.frontends[frontendKey{network: "tcp4", bind: bind1}].cfg.Deny,
+		"changed global default should have been applied")
+}
+
+func TestReconcileSharesAccessLogFiles(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	bind1, bind2 := freePort(t), freePort(t)
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{
+			{Bind: bind1, HealthInterval: 60, AccessLog: &config.AccessLog{Path: path}},
+			{Bind: bind2, HealthInterval: 60, AccessLog: &config.AccessLog{Path: path}},
+		},
+	}
+
+	p := NewL4Proxy(cfg, logr.Discard(), nil, nil)
+	p.Start()
+	require.Len(t, p.accessLogs.logs, 1)
+	require.Equal(t, 2, p.accessLogs.logs[path].refs)
+
+	cfg.Frontends = cfg.Frontends[:1]
+	p.Reconcile(cfg)
+	p.draining.Wait()
+	require.Equal(t, 1, p.accessLogs.logs[path].refs, "file should be kept open for the remaining frontend")
+
+	// a connection to a frontend without healthy backends is rejected and logged.
+	conn, err := net.Dial("tcp4", bind1)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, conn.Close())
+
+	p.Stop()
+	require.Empty(t, p.accessLogs.logs, "file should have been closed")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"client":"`+conn.LocalAddr().String()+`"`)
+}
+
+func TestShutdownStopsFrontendsAndIgnoresLaterConfigurations(t *testing.T) {
+	t.Parallel()
+
+	bind := freePort(t)
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends:  []config.Frontend{{Bind: bind, HealthInterval: 60}},
+	}
+
+	p := NewL4Proxy(cfg, logr.Discard(), nil, nil)
+	p.Start()
+	require.Len(t, p.Frontends(), 1)
+
+	p.Shutdown(t.Context())
+	require.Empty(t, p.Frontends())
+	_, err := net.Dial("tcp4", bind)
+	require.Error(t, err, "frontend should have stopped accepting connections")
+
+	p.Reconcile(cfg)
+	require.Empty(t, p.Frontends(), "configurations should be ignored after shutting down")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// exitForced is the exit code used when the process is terminated before draining has finished.
+	exitForced = 1
+	// defaultShutdownGracePeriod is the default time connections are given to finish when the process is terminated.
+	defaultShutdownGracePeriod = 30 * time.Second
+)
+
+// handleSignals handles the signals received on sigCh until the process should exit and returns its exit code. SIGHUP
+// calls reload. The first SIGTERM or SIGINT calls shutdown in the background and handleSignals returns once shutdown
+// returns. A second SIGTERM or SIGINT during shutdown makes handleSignals return immediately with exitForced.
+func handleSignals(sigCh <-chan os.Signal, reload, shutdown func(), log logr.Logger) int {
+	var done chan struct{}
+	for {
+		select {
+		case <-done:
+			log.Info("shutdown complete")
+			return 0
+		case sig := <-sigCh:
+			switch {
+			case sig == syscall.SIGHUP && done == nil:
+				log.Info("received SIGHUP, reloading configuration and reopening access logs")
+				reload()
+			case sig == syscall.SIGHUP:
+				log.V(2).Info("ignoring SIGHUP during shutdown")
+			case done == nil:
+				log.Info("received signal, shutting down", "signal", sig.String())
+				done = make(chan struct{})
+				go func() {
+					shutdown()
+					close(done)
+				}()
+			default:
+				log.Info("received second signal, exiting without waiting for connections to finish", "signal", sig.String())
+				return exitForced
+			}
+		}
+	}
+}
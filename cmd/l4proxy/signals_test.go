@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleSignalsReloadsAndShutsDown(t *testing.T) {
+	t.Parallel()
+
+	sigCh := make(chan os.Signal)
+	var reloads atomic.Int32
+	shutdownCh := make(chan struct{})
+	exitCh := make(chan int)
+	go func() {
+		exitCh <- handleSignals(sigCh, func() { reloads.Add(1) }, func() { <-shutdownCh }, logr.Discard())
+	}()
+
+	sigCh <- syscall.SIGHUP
+	sigCh <- syscall.SIGHUP
+	sigCh <- syscall.SIGTERM
+	// SIGHUP doesn't reload anymore while shutting down.
+	sigCh <- syscall.SIGHUP
+	require.Equal(t, int32(2), reloads.Load())
+
+	select {
+	case code := <-exitCh:
+		require.Fail(t, "handleSignals returned before shutdown finished", "exit code %d", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(shutdownCh)
+	require.Equal(t, 0, <-exitCh)
+}
+
+func TestHandleSignalsForcesExitOnSecondSignal(t *testing.T) {
+	t.Parallel()
+
+	sigCh := make(chan os.Signal)
+	// shutdown never finishes on its own.
+	shutdownCh := make(chan struct{})
+	t.Cleanup(func() { close(shutdownCh) })
+	exitCh := make(chan int)
+	go func() {
+		exitCh <- handleSignals(sigCh, func() {}, func() { <-shutdownCh }, logr.Discard())
+	}()
+
+	sigCh <- syscall.SIGINT
+	sigCh <- syscall.SIGTERM
+	require.Equal(t, exitForced, <-exitCh)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-logr/logr"
+
+	"github.com/makkes/l4proxy/config"
+	"github.com/makkes/l4proxy/frontend"
+)
+
+// serverTLSConfig returns the TLS configuration of a frontend terminating TLS. The certificate is reloaded when its
+// files change.
+func serverTLSConfig(cfg *config.TLS, log logr.Logger) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("certFile and keyFile are required")
+	}
+	reloader, err := frontend.NewCertificateReloader(cfg.CertFile, cfg.KeyFile, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading certificate: %w", err)
+	}
+
+	minVersion, err := tlsVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := cipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{ //nolint:gosec // the minimum version is configurable and defaults to TLS 1.2.
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clientCAFile setting: %w", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// backendTLSConfig returns the TLS configuration for connecting to a backend.
+func backendTLSConfig(cfg *config.BackendTLS) (*tls.Config, error) {
+	tlsCfg := &tls.Config{ //nolint:gosec // skipping verification is an explicit choice of the user.
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid caFile setting: %w", err)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// tlsVersion returns the TLS version with the given name. An empty name defaults to TLS 1.2.
+func tlsVersion(name string) (uint16, error) {
+	switch name {
+	case config.TLSVersion10:
+		return tls.VersionTLS10, nil
+	case config.TLSVersion11:
+		return tls.VersionTLS11, nil
+	case "", config.TLSVersion12:
+		return tls.VersionTLS12, nil
+	case config.TLSVersion13:
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q, expected one of %s, %s, %s, %s", name,
+			config.TLSVersion10, config.TLSVersion11, config.TLSVersion12, config.TLSVersion13)
+	}
+}
+
+// cipherSuites returns the IDs of the cipher suites with the given names. Only suites without known security issues
+// are supported. It returns nil if no names are given so that Go's defaults are used.
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	supported := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := supported[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadCertPool reads a bundle of PEM-encoded certificates from the given file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file) //nolint:gosec // the file is configured by the user.
+	if err != nil {
+		return nil, fmt.Errorf("failed reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/makkes/l4proxy/config"
+)
+
+// Exit codes of the validate subcommand.
+const (
+	exitInvalid = 1
+	exitUsage   = 2
+)
+
+// runValidate implements the validate subcommand, which reads and validates configuration files without starting any
+// frontends, e.g. in CI before deploying configuration changes. Files that are valid on their own are also checked for
+// conflicts with each other, see [config.Merge]. Problems are printed to errOut, one per line. It returns the process'
+// exit code, which is zero if all files are valid.
+func runValidate(args []string, out, errOut io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	var configPaths []string
+	flags.StringSliceVarP(&configPaths, "config", "c", nil,
+		"configuration files, directories containing *.yaml and *.yml files or glob patterns to validate")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	files, err := configFiles(append(configPaths, flags.Args()...))
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return exitUsage
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(errOut, "no config file provided")
+		return exitUsage
+	}
+
+	code := 0
+	cfgs := make([]*config.Config, 0, len(files))
+	for _, file := range files {
+		cfg, err := config.Read(file)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			code = exitInvalid
+			continue
+		}
+		if err := cfg.Validate(); err != nil {
+			printProblems(errOut, err)
+			code = exitInvalid
+			continue
+		}
+		cfgs = append(cfgs, cfg)
+		fmt.Fprintf(out, "%s: configuration is valid\n", file)
+	}
+	if _, err := config.Merge(cfgs...); err != nil {
+		printProblems(errOut, err)
+		code = exitInvalid
+	}
+	return code
+}
+
+// printProblems prints each problem of a [*config.ValidationError] on its own line.
+func printProblems(w io.Writer, err error) {
+	var vErr *config.ValidationError
+	if !errors.As(err, &vErr) {
+		fmt.Fprintln(w, err)
+		return
+	}
+	for _, p := range vErr.Problems {
+		fmt.Fprintln(w, p)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunValidate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	require.NoError(t, os.WriteFile(valid, []byte(`apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:80
+`), 0o600))
+	invalid := filepath.Join(dir, "invalid.yaml")
+	require.NoError(t, os.WriteFile(invalid, []byte(`apiVersion: v1
+frontends:
+  - bind: :80
+    backends:
+      - address: 10.0.0.100:80
+`), 0o600))
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, runValidate([]string{"-c", valid}, &out, &errOut))
+	require.Equal(t, valid+": configuration is valid\n", out.String())
+	require.Empty(t, errOut.String())
+
+	out.Reset()
+	require.Equal(t, exitInvalid, runValidate([]string{"-c", valid, "--config", invalid}, &out, &errOut))
+	require.Equal(t, valid+": configuration is valid\n", out.String())
+	require.Equal(t, invalid+":3: frontends[0].healthInterval: healthInterval must be a positive number of seconds\n",
+		errOut.String())
+
+	require.Equal(t, exitUsage, runValidate(nil, &out, &errOut))
+}
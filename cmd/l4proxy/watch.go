@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// errInotifyUnsupported is returned by watchInotify on platforms without inotify.
+var errInotifyUnsupported = errors.New("inotify is not supported on this platform")
+
+const (
+	// pollInterval is the time between two checks of the configuration files if they can't be watched.
+	pollInterval = 3 * time.Second
+	// debounceInterval is the time without further events after which changes of the configuration files are
+	// processed so that bursts of writes only result in a single reload.
+	debounceInterval = 200 * time.Millisecond
+)
+
+// watchConfig watches the configuration files and sends an update to updateCh when a file has been modified, added or
+// removed, see changedFile. It uses inotify if available and checks the files periodically otherwise. It
+// returns when ctx is done.
+func watchConfig(ctx context.Context, paths []string, updateCh chan<- configUpdate, log logr.Logger) {
+	err := watchInotify(ctx, paths, updateCh, log)
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, errInotifyUnsupported):
+		log.V(2).Info("checking configuration files periodically", "interval", pollInterval)
+	default:
+		log.Error(err, "failed watching configuration files, checking them periodically instead")
+	}
+	pollConfigFiles(ctx, paths, pollInterval, updateCh, log)
+}
+
+// pollConfigFiles checks the configuration files for changes every interval. It returns when ctx is done.
+func pollConfigFiles(ctx context.Context, paths []string, interval time.Duration, updateCh chan<- configUpdate, log logr.Logger) {
+	last := configDigests(paths, log)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := configDigests(paths, log)
+		if !notifyChange(ctx, last, current, updateCh) {
+			return
+		}
+		last = current
+	}
+}
+
+// notifyChange sends an update naming a changed file to updateCh if the configuration files changed between two
+// snapshots. It returns false if ctx is done before the update has been sent.
+func notifyChange(ctx context.Context, last, current map[string][sha256.Size]byte, updateCh chan<- configUpdate) bool {
+	changed := changedFile(last, current)
+	if changed == "" {
+		return true
+	}
+	select {
+	case updateCh <- configUpdate{file: changed}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// configDigests returns the digests of the contents of all configuration files. Comparing contents instead of
+// modification times detects all changes, regardless of the resolution of modification times and of symlinks being
+// replaced.
+func configDigests(paths []string, log logr.Logger) map[string][sha256.Size]byte {
+	files, err := configFiles(paths)
+	if err != nil {
+		log.Error(err, "failed listing configuration files")
+	}
+	digests := make(map[string][sha256.Size]byte, len(files))
+	for _, file := range files {
+		//gosec:disable G304 -- the configuration files are provided by the operator
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Error(err, "failed reading configuration file for change detection", "config_file", file)
+			continue
+		}
+		digests[file] = sha256.Sum256(data)
+	}
+	return digests
+}
+
+// changedFile returns a file that has been added, removed or modified between two snapshots or an empty string if
+// nothing changed.
+func changedFile[V comparable](last, current map[string]V) string {
+	for _, file := range slices.Sorted(maps.Keys(current)) {
+		if v, ok := last[file]; !ok || v != current[file] {
+			return file
+		}
+	}
+	for _, file := range slices.Sorted(maps.Keys(last)) {
+		if _, ok := current[file]; !ok {
+			return file
+		}
+	}
+	return ""
+}
+
+// watchedDirs returns the directories to watch for changes of the configuration files: the directories containing
+// the files and their symlink targets, the configured directories and their parents. Watching directories instead of
+// files catches files being created and replaced, e.g. by renaming a new file over the old one or by swapping a
+// symlink like Kubernetes does for ConfigMaps.
+func watchedDirs(paths []string) []string {
+	var dirs []string
+	add := func(dir string) {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, path := range paths {
+		if dir := filepath.Dir(path); !strings.ContainsAny(dir, "*?[") {
+			add(dir)
+		}
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			add(filepath.Clean(path))
+		}
+	}
+	files, err := configFiles(paths)
+	if err != nil {
+		return dirs
+	}
+	for _, file := range files {
+		add(filepath.Dir(file))
+		if resolved, err := filepath.EvalSymlinks(file); err == nil {
+			add(filepath.Dir(resolved))
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// inotifyMask selects all events that may change the contents of the watched configuration files, including files
+// being created, removed and renamed, and the watched directories themselves being replaced.
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// watchInotify watches the directories containing the configuration files using inotify, see watchedDirs. Events are
+// debounced and only result in an update if the contents of the files changed, see configDigests. It returns when ctx
+// is done or an error if the files can't be watched.
+func watchInotify(ctx context.Context, paths []string, updateCh chan<- configUpdate, log logr.Logger) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed initializing inotify: %w", err)
+	}
+	// The file is non-blocking so that closing it interrupts pending reads.
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Error(err, "failed closing inotify file descriptor")
+		}
+	}()
+
+	if err := addInotifyWatches(fd, paths); err != nil {
+		return err
+	}
+	last := configDigests(paths, log)
+
+	events := make(chan struct{}, 1)
+	go readInotifyEvents(f, events, log)
+
+	debounce := time.NewTimer(debounceInterval)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-events:
+			debounce.Reset(debounceInterval)
+		case <-debounce.C:
+			// Directories may have been created or replaced, e.g. the target of a swapped symlink.
+			if err := addInotifyWatches(fd, paths); err != nil {
+				log.Error(err, "failed watching configuration files")
+			}
+			current := configDigests(paths, log)
+			if !notifyChange(ctx, last, current, updateCh) {
+				return nil
+			}
+			last = current
+		}
+	}
+}
+
+// addInotifyWatches adds a watch for each of the directories returned by watchedDirs. Directories that don't exist
+// are skipped. Adding a watch for a directory that is already watched is a no-op.
+func addInotifyWatches(fd int, paths []string) error {
+	var errs []error
+	for _, dir := range watchedDirs(paths) {
+		if _, err := syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, fmt.Errorf("failed watching %s: %w", dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readInotifyEvents signals each batch of events read from f on events until f is closed. The events themselves
+// aren't inspected since the configuration files are compared after each burst of events anyway.
+func readInotifyEvents(f *os.File, events chan<- struct{}, log logr.Logger) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		if _, err := f.Read(buf); err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Error(err, "failed reading inotify events")
+			}
+			return
+		}
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchInotifyReportsModifiedFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.yaml")
+	writeFile(t, path, "apiVersion: v1\n")
+
+	updateCh := make(chan configUpdate)
+	go func() {
+		if err := watchInotify(t.Context(), []string{path}, updateCh, logr.Discard()); err != nil {
+			t.Errorf("failed watching: %s", err)
+		}
+	}()
+
+	requireUpdate(t, updateCh, path, func(i int) {
+		writeFile(t, path, fmt.Sprintf("apiVersion: v1\n# %d\n", i))
+	})
+
+	// rewriting the same contents doesn't result in an update.
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	writeFile(t, path, string(content))
+	select {
+	case update := <-updateCh:
+		require.Fail(t, "unexpected update", "changed file %s", update.file)
+	case <-time.After(3 * debounceInterval):
+	}
+}
+
+func TestWatchInotifyFollowsSymlinkSwaps(t *testing.T) {
+	t.Parallel()
+
+	// the layout resembles a Kubernetes ConfigMap volume where ..data is replaced atomically on updates.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.yaml")
+	writeFile(t, filepath.Join(dir, "..v0", "proxy.yaml"), "apiVersion: v1\n")
+	require.NoError(t, os.Symlink("..v0", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "proxy.yaml"), path))
+
+	updateCh := make(chan configUpdate)
+	go func() {
+		if err := watchInotify(t.Context(), []string{path}, updateCh, logr.Discard()); err != nil {
+			t.Errorf("failed watching: %s", err)
+		}
+	}()
+
+	requireUpdate(t, updateCh, path, func(i int) {
+		version := fmt.Sprintf("..v%d", i+1)
+		writeFile(t, filepath.Join(dir, version, "proxy.yaml"), fmt.Sprintf("apiVersion: v1\n# %d\n", i))
+		require.NoError(t, os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+		require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	})
+}
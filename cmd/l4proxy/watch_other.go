@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+)
+
+// watchInotify always returns errInotifyUnsupported since inotify is only available on Linux.
+func watchInotify(context.Context, []string, chan<- configUpdate, logr.Logger) error {
+	return errInotifyUnsupported
+}
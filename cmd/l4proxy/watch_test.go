@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedFile(t *testing.T) {
+	t.Parallel()
+
+	last := map[string]int{"a": 1, "b": 2}
+	require.Empty(t, changedFile(last, map[string]int{"b": 2, "a": 1}))
+	require.Equal(t, "b", changedFile(last, map[string]int{"a": 1, "b": 3}))
+	require.Equal(t, "c", changedFile(last, map[string]int{"a": 1, "b": 2, "c": 3}))
+	require.Equal(t, "a", changedFile(last, map[string]int{"b": 2}))
+}
+
+func TestWatchedDirsFollowSymlinks(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "data", "proxy.yaml"), "")
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "config"), 0o700))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "data", "proxy.yaml"), filepath.Join(dir, "config", "proxy.yaml")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "conf.d"), 0o700))
+
+	require.Equal(t, []string{
+		filepath.Join(dir, "config"),
+		dir,
+		filepath.Join(dir, "conf.d"),
+		filepath.Join(dir, "data"),
+	}, watchedDirs([]string{
+		filepath.Join(dir, "config", "proxy.yaml"),
+		filepath.Join(dir, "conf.d"),
+		filepath.Join(dir, "*", "*.yml"),
+	}))
+}
+
+func TestPollConfigFilesReportsChangedContents(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.yaml")
+	writeFile(t, path, "apiVersion: v1\n")
+
+	updateCh := make(chan configUpdate)
+	go pollConfigFiles(t.Context(), []string{dir}, 10*time.Millisecond, updateCh, logr.Discard())
+
+	requireUpdate(t, updateCh, path, func(i int) {
+		// the size stays the same so that only the contents differ.
+		writeFile(t, path, "apiVersion: v"+string(rune('2'+i%8))+"\n")
+	})
+}
+
+// requireUpdate calls change until the watcher sends an update for path to updateCh. Changing files repeatedly makes sure that a
+// change is made after the watcher took its initial snapshot. Changes are made less often than debounceInterval so
+// that they don't postpone the update forever.
+func requireUpdate(t *testing.T, updateCh <-chan configUpdate, path string, change func(i int)) {
+	t.Helper()
+
+	for i := range 10 {
+		change(i)
+		select {
+		case update := <-updateCh:
+			require.Equal(t, configUpdate{file: path}, update)
+			return
+		case <-time.After(3 * debounceInterval):
+		}
+	}
+	require.Fail(t, "no update received", "path %s", path)
+}
@@ -63,6 +63,9 @@ func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	cfg := l4proxyconfig.Config{
 		APIVersion: l4proxyconfig.APIVersionV1,
 	}
+	// services sharing a port, e.g. with several ingress IPs, are served by a single frontend as l4proxy can't bind
+	// the same address twice.
+	frontendIdx := make(map[string]int)
 
 	for idx := range svcs.Items {
 		svc := svcs.Items[idx]
@@ -71,27 +74,44 @@ func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 		}
 		for _, ingress := range svc.Status.LoadBalancer.Ingress {
 			for _, port := range svc.Spec.Ports {
-				if port.Protocol == "TCP" {
-					fe := l4proxyconfig.Frontend{
-						Bind: fmt.Sprintf("%s:%d", r.bind, port.Port),
-						Backends: []l4proxyconfig.Backend{{
-							Address: fmt.Sprintf("%s:%d", ingress.IP, port.Port),
-						}},
-						HealthInterval: r.healthInterval,
-					}
-					if hiAnn, ok := svc.Annotations[AnnotationHealthInterval]; ok {
-						hi, err := strconv.Atoi(hiAnn)
-						if err != nil {
-							log.Error(err, "failed parsing annotation value",
-								"namespace", svc.Namespace,
-								"service", svc.Name,
-								"annotation", AnnotationHealthInterval,
-							)
-						}
+				var protocol string
+				switch port.Protocol {
+				case corev1.ProtocolTCP:
+					protocol = "tcp"
+				case corev1.ProtocolUDP:
+					protocol = "udp"
+				default:
+					log.Info("skipping port with unsupported protocol",
+						"namespace", svc.Namespace, "service", svc.Name, "port", port.Port, "protocol", port.Protocol)
+					continue
+				}
+				fe := l4proxyconfig.Frontend{
+					Bind:     fmt.Sprintf("%s:%d", r.bind, port.Port),
+					Protocol: protocol,
+					Backends: []l4proxyconfig.Backend{{
+						Address: fmt.Sprintf("%s:%d", ingress.IP, port.Port),
+					}},
+					HealthInterval: r.healthInterval,
+				}
+				if hiAnn, ok := svc.Annotations[AnnotationHealthInterval]; ok {
+					hi, err := strconv.Atoi(hiAnn)
+					if err != nil {
+						log.Error(err, "failed parsing annotation value",
+							"namespace", svc.Namespace,
+							"service", svc.Name,
+							"annotation", AnnotationHealthInterval,
+						)
+					} else {
 						fe.HealthInterval = hi
 					}
-					cfg.Frontends = append(cfg.Frontends, fe)
 				}
+				key := protocol + "/" + fe.Bind
+				if idx, ok := frontendIdx[key]; ok {
+					cfg.Frontends[idx].Backends = append(cfg.Frontends[idx].Backends, fe.Backends...)
+					continue
+				}
+				frontendIdx[key] = len(cfg.Frontends)
+				cfg.Frontends = append(cfg.Frontends, fe)
 			}
 		}
 	}
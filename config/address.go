@@ -0,0 +1,87 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// splitHostPort splits an address of the form [host:]port the same way frontends and backends parse it. An address
+// without a colon is a port only. The port may be a number or a service name of the given protocol.
+func splitHostPort(hp, protocol string) (string, int, error) {
+	host, port := "", hp
+	if strings.Contains(hp, ":") {
+		var err error
+		host, port, err = net.SplitHostPort(hp)
+		if err != nil {
+			return "", 0, fmt.Errorf("expected [host:]port: %w", err)
+		}
+	}
+	if port == "" {
+		return "", 0, errors.New("missing port")
+	}
+	portNum, err := net.LookupPort(cmp.Or(protocol, ProtocolTCP), port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q, expected [host:]port", port)
+	}
+	return host, portNum, nil
+}
+
+// listenAddr is the normalized address a frontend listens on. Addresses that are spelled differently but result in
+// the same listener, like ":80" and "0.0.0.0:80", are equal.
+type listenAddr struct {
+	// network is the network as returned by network, e.g. "tcp4" or "tcp" for dual-stack listeners.
+	network string
+	// host is empty for the wildcard address. IP addresses are in their canonical form; hostnames and interfaces are
+	// compared as given.
+	host string
+	port int
+	// unparsed is set for addresses of frontends with an invalid bind, protocol or family. They don't overlap with any
+	// other address.
+	unparsed bool
+}
+
+// parseListenAddr returns the normalized listen address of a frontend.
+func parseListenAddr(fe Frontend) (listenAddr, error) {
+	nw, err := Network(fe.Protocol, fe.Family)
+	if err != nil {
+		return listenAddr{}, err
+	}
+	host, port, err := splitHostPort(fe.Bind, fe.Protocol)
+	if err != nil {
+		return listenAddr{}, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.String()
+		if ip.IsUnspecified() {
+			host = ""
+		}
+	}
+	return listenAddr{network: nw, host: strings.ToLower(host), port: port}, nil
+}
+
+func (a listenAddr) String() string {
+	return a.network + "/" + net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+// overlaps reports whether both addresses can't be listened on at the same time: they use the same protocol and port,
+// their address families overlap, with dual-stack listeners overlapping both families, and either their hosts are the
+// same or one of them is the wildcard address.
+func (a listenAddr) overlaps(b listenAddr) bool {
+	if a.unparsed || b.unparsed {
+		return false
+	}
+	protoA, famA := a.network[:3], a.network[3:]
+	protoB, famB := b.network[:3], b.network[3:]
+	if protoA != protoB || a.port != b.port {
+		return false
+	}
+	if famA != "" && famB != "" && famA != famB {
+		return false
+	}
+	return a.host == b.host || a.host == "" || b.host == ""
+}
@@ -2,7 +2,10 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -23,6 +26,12 @@ type Config struct {
 	// to be applied to the configuration in which case this version is increased.
 	APIVersion APIVersion `json:"api_version" yaml:"apiVersion"`
 	Frontends  []Frontend `json:"frontends"   yaml:"frontends"`
+	// Allow and Deny are the defaults for the frontends' Allow and Deny settings.
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"  yaml:"deny,omitempty"`
+	// file and positions locate the settings of a configuration read from a file for reporting problems.
+	file      string
+	positions positions
 }
 
 // Frontend represents the configuration of a frontend and one or more backends.
@@ -31,14 +40,269 @@ type Frontend struct {
 	Backends       []Backend     `json:"backends"        yaml:"backends"`
 	HealthInterval int           `json:"health_interval" yaml:"healthInterval"`
 	Timeout        time.Duration `json:"timeout"         yaml:"timeout"`
+	// Protocol is the transport protocol of the frontend and its backends, either "tcp" (the default) or "udp".
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	// Family is the IP address family of the frontend's listener, either "ipv4" (the default), "ipv6" or "dual" for
+	// listening on both. Backends given as IP address are always dialed using that address' family.
+	Family string `json:"family,omitempty" yaml:"family,omitempty"`
+	// Balance selects the load-balancing strategy used for distributing connections across the backends. One of
+	// "random" (the default), "round-robin", "weighted-round-robin" or "least-connections".
+	Balance string `json:"balance,omitempty" yaml:"balance,omitempty"`
+	// DrainTimeout is the time connections are given to finish when the frontend is stopped, e.g. because it has been
+	// removed from the configuration. Connections still open afterwards are closed forcibly. Defaults to 30s. UDP
+	// sessions are not drained.
+	DrainTimeout time.Duration `json:"drain_timeout,omitempty" yaml:"drainTimeout,omitempty"`
+	// SendProxyProtocol is the default for the backends' SendProxyProtocol setting.
+	SendProxyProtocol string `json:"send_proxy_protocol,omitempty" yaml:"sendProxyProtocol,omitempty"`
+	// AcceptProxyProtocol makes the frontend expect a PROXY protocol header (version 1 or 2) at the start of each
+	// connection, e.g. when l4proxy runs behind another load balancer. The client address from the header is used
+	// instead of the connection's source address. Connections with a missing or malformed header are rejected. Only
+	// supported for TCP.
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol,omitempty" yaml:"acceptProxyProtocol,omitempty"`
+	// TrustedProxies is a list of IP addresses or CIDR networks allowed to send PROXY protocol headers. Connections
+	// from other sources are rejected. If empty, all sources are trusted.
+	TrustedProxies []string `json:"trusted_proxies,omitempty" yaml:"trustedProxies,omitempty"`
+	// Allow is a list of IP addresses or CIDR networks connections are accepted from. If empty, connections from all
+	// sources are accepted unless denied. Overrides the global Allow setting.
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	// Deny is a list of IP addresses or CIDR networks connections are rejected from, taking precedence over Allow.
+	// Overrides the global Deny setting.
+	Deny []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+	// Limits restricts the connections handled by the frontend.
+	Limits *Limits `json:"limits,omitempty" yaml:"limits,omitempty"`
+	// HealthCheck is the default for the backends' HealthCheck setting.
+	HealthCheck *HealthCheck `json:"health_check,omitempty" yaml:"healthCheck,omitempty"`
+	// OutlierDetection enables passive health checking of the frontend's backends based on the connections proxied to
+	// them.
+	OutlierDetection *OutlierDetection `json:"outlier_detection,omitempty" yaml:"outlierDetection,omitempty"`
+	// Retries is the number of other healthy backends tried when connecting to the backend selected for a client
+	// connection fails. Defaults to 2, 0 disables retries.
+	Retries *int `json:"retries,omitempty" yaml:"retries,omitempty"`
+	// ConnectTimeout is the time after which an attempt to connect to a backend is given up. Defaults to 5s.
+	ConnectTimeout time.Duration `json:"connect_timeout,omitempty" yaml:"connectTimeout,omitempty"`
+	// IdleTimeout is the time after which connections on which no data has been transferred in either direction are
+	// closed. Defaults to 30s. Overrides Timeout, the former name of this setting.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty" yaml:"idleTimeout,omitempty"`
+	// ClientIdleTimeout is the time after which connections on which the client hasn't sent any data are closed, even
+	// if the backend is still sending data. Disabled if zero.
+	ClientIdleTimeout time.Duration `json:"client_idle_timeout,omitempty" yaml:"clientIdleTimeout,omitempty"`
+	// BackendIdleTimeout is the time after which connections on which the backend hasn't sent any data are closed,
+	// even if the client is still sending data. Disabled if zero.
+	BackendIdleTimeout time.Duration `json:"backend_idle_timeout,omitempty" yaml:"backendIdleTimeout,omitempty"`
+	// MaxConnectionLifetime is the time after which connections are closed regardless of their activity so that
+	// long-lived connections are rebalanced eventually, e.g. after new backends have been deployed. Disabled if zero.
+	MaxConnectionLifetime time.Duration `json:"max_connection_lifetime,omitempty" yaml:"maxConnectionLifetime,omitempty"`
+	// SNIRouting makes the frontend route TLS connections by the server name requested in the ClientHello without
+	// terminating TLS. Connections are proxied to the backends whose ServerNames match the requested name most
+	// specifically or, if none matches, to the backends without ServerNames. Only supported for TCP.
+	SNIRouting bool `json:"sni_routing,omitempty" yaml:"sniRouting,omitempty"`
+	// TLS makes the frontend terminate TLS. Only supported for TCP.
+	TLS *TLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// BackendTLS is the default for the backends' TLS setting.
+	BackendTLS *BackendTLS `json:"backend_tls,omitempty" yaml:"backendTLS,omitempty"`
+	// AccessLog makes the frontend write an entry for every client connection when it has been closed.
+	AccessLog *AccessLog `json:"access_log,omitempty" yaml:"accessLog,omitempty"`
+}
+
+// Protocols supported in [Frontend].
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// Address families supported in [Frontend].
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyDual = "dual"
+)
+
+// Load-balancing strategies supported in [Frontend].
+const (
+	BalanceRandom             = "random"
+	BalanceRoundRobin         = "round-robin"
+	BalanceWeightedRoundRobin = "weighted-round-robin"
+	BalanceLeastConnections   = "least-connections"
+)
+
+// PROXY protocol versions supported in [Frontend] and [Backend].
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// Network returns the network name as understood by the [net] package for the given protocol and address family, e.g.
+// "tcp4". An empty protocol defaults to [ProtocolTCP] and an empty family defaults to [FamilyIPv4].
+func Network(protocol, family string) (string, error) {
+	switch protocol {
+	case "":
+		protocol = ProtocolTCP
+	case ProtocolTCP, ProtocolUDP:
+	default:
+		return "", fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	switch family {
+	case "", FamilyIPv4:
+		return protocol + "4", nil
+	case FamilyIPv6:
+		return protocol + "6", nil
+	case FamilyDual:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unsupported address family %q", family)
+	}
+}
+
+// AccessLog represents the configuration of a frontend's access log. Entries are written as JSON objects, one per line.
+type AccessLog struct {
+	// Path is the path of the file entries are appended to or "-" for standard output. Frontends may share a file.
+	// Files are reopened on SIGHUP so that they can be rotated by external tools.
+	Path string `json:"path" yaml:"path"`
+	// MaxSizeMB is the size in megabytes at which the file is rotated by renaming it to "<path>.1". Disabled if zero.
+	// Frontends sharing a file should use the same settings.
+	MaxSizeMB int `json:"max_size_mb,omitempty" yaml:"maxSizeMB,omitempty"`
+	// MaxBackups is the number of rotated files kept. Defaults to 5.
+	MaxBackups int `json:"max_backups,omitempty" yaml:"maxBackups,omitempty"`
 }
 
 // Backend represents the configuration of a single backend.
 type Backend struct {
 	Address string `json:"address" yaml:"address"`
+	// Weight is the relative share of connections this backend receives when the "weighted-round-robin" strategy is
+	// used. Defaults to 1.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// SendProxyProtocol makes l4proxy send a PROXY protocol header of the given version ("v1" or "v2") to the backend
+	// at the start of each connection so that the backend application learns the original client address. Overrides
+	// the frontend's setting. Only supported for TCP.
+	SendProxyProtocol string `json:"send_proxy_protocol,omitempty" yaml:"sendProxyProtocol,omitempty"`
+	// HealthCheck configures how the backend's health is checked. Overrides the frontend's setting. Defaults to
+	// connecting to the backend.
+	HealthCheck *HealthCheck `json:"health_check,omitempty" yaml:"healthCheck,omitempty"`
+	// ServerNames lists the TLS server names the backend serves on a frontend with SNIRouting enabled. Names are exact
+	// hostnames like "app.example.com" or wildcards like "*.example.com" matching all subdomains.
+	ServerNames []string `json:"server_names,omitempty" yaml:"serverNames,omitempty"`
+	// TLS makes l4proxy connect to the backend using TLS, e.g. for re-encrypting connections on a frontend
+	// terminating TLS. Overrides the frontend's BackendTLS setting.
+	TLS *BackendTLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// MaxConnections is the maximum number of connections proxied to the backend concurrently. Backends at the limit
+	// don't receive new connections. Unlimited if zero.
+	MaxConnections int `json:"max_connections,omitempty" yaml:"maxConnections,omitempty"`
+}
+
+// Limits represents the connection limits of a frontend. Zero values disable the respective limit.
+type Limits struct {
+	// MaxConnections is the maximum number of connections handled by the frontend concurrently.
+	MaxConnections int `json:"max_connections,omitempty" yaml:"maxConnections,omitempty"`
+	// QueueTimeout makes connections exceeding MaxConnections wait for up to the given time for other connections
+	// to finish before they are rejected. By default, they are rejected immediately.
+	QueueTimeout time.Duration `json:"queue_timeout,omitempty" yaml:"queueTimeout,omitempty"`
+	// MaxConnectionsPerSource is the maximum number of concurrent connections from a single source IP address.
+	MaxConnectionsPerSource int `json:"max_connections_per_source,omitempty" yaml:"maxConnectionsPerSource,omitempty"`
+	// RatePerSource is the number of new connections per second accepted from a single source IP address.
+	RatePerSource float64 `json:"rate_per_source,omitempty" yaml:"ratePerSource,omitempty"`
+	// BurstPerSource is the number of connections a single source IP address may open at once before RatePerSource
+	// applies. Defaults to RatePerSource rounded up.
+	BurstPerSource int `json:"burst_per_source,omitempty" yaml:"burstPerSource,omitempty"`
 }
 
-// Read reads a [Config] from the given file. A non-nil error is returned when the file can't be opened or its format is unrecognized.
+// TLS versions supported in [TLS].
+const (
+	TLSVersion10 = "1.0"
+	TLSVersion11 = "1.1"
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// TLS represents the configuration of TLS termination on a frontend.
+type TLS struct {
+	// CertFile and KeyFile are the paths of the PEM-encoded certificate (chain) and private key presented to clients.
+	// The files are reloaded when they change.
+	CertFile string `json:"cert_file" yaml:"certFile"`
+	KeyFile  string `json:"key_file"  yaml:"keyFile"`
+	// MinVersion is the minimum TLS version accepted from clients, one of "1.0", "1.1", "1.2" (the default) or "1.3".
+	MinVersion string `json:"min_version,omitempty" yaml:"minVersion,omitempty"`
+	// CipherSuites restricts the cipher suites used for TLS 1.2 and earlier to the given ones, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". TLS 1.3 cipher suites are not configurable. Defaults to Go's secure
+	// default cipher suites.
+	CipherSuites []string `json:"cipher_suites,omitempty" yaml:"cipherSuites,omitempty"`
+	// ClientCAFile is the path of a PEM-encoded bundle of CA certificates. If set, clients must present a certificate
+	// signed by one of the CAs.
+	ClientCAFile string `json:"client_ca_file,omitempty" yaml:"clientCAFile,omitempty"`
+}
+
+// BackendTLS represents the configuration of TLS connections to a backend.
+type BackendTLS struct {
+	// ServerName is used for verifying the backend's certificate and sent as SNI. Defaults to the host part of the
+	// backend's address.
+	ServerName string `json:"server_name,omitempty" yaml:"serverName,omitempty"`
+	// CAFile is the path of a PEM-encoded bundle of CA certificates used for verifying the backend's certificate.
+	// Defaults to the system's CAs.
+	CAFile string `json:"ca_file,omitempty" yaml:"caFile,omitempty"`
+	// InsecureSkipVerify disables the verification of the backend's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+}
+
+// Health check types supported in [HealthCheck].
+const (
+	HealthCheckTCP   = "tcp"
+	HealthCheckHTTP  = "http"
+	HealthCheckHTTPS = "https"
+	HealthCheckTLS   = "tls"
+)
+
+// HealthCheck represents the configuration of a backend health check.
+type HealthCheck struct {
+	// Type is one of "tcp" (the default), "http", "https" or "tls". A "tcp" check connects to the backend and
+	// optionally exchanges data according to Send and Expect, a "tls" check completes a TLS handshake and "http" and
+	// "https" checks send a GET request. Only "tcp" checks are supported for UDP backends.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// Send is sent to the backend by a "tcp" check after connecting, e.g. "PING\r\n".
+	Send string `json:"send,omitempty" yaml:"send,omitempty"`
+	// Expect makes a "tcp" check only succeed if the backend's response contains it, e.g. "SSH-" or "+PONG".
+	Expect string `json:"expect,omitempty" yaml:"expect,omitempty"`
+	// Path is the path requested by "http" and "https" checks. Defaults to "/".
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Host is sent as Host header by "http" and "https" checks and used as server name for verifying the backend's
+	// certificate by "https" and "tls" checks. Defaults to the backend's address.
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+	// ExpectStatus lists the HTTP status codes of healthy backends. Defaults to all 2xx and 3xx codes.
+	ExpectStatus []int `json:"expect_status,omitempty" yaml:"expectStatus,omitempty"`
+	// ExpectBody makes "http" and "https" checks only succeed if the response body contains it.
+	ExpectBody string `json:"expect_body,omitempty" yaml:"expectBody,omitempty"`
+	// InsecureSkipVerify disables the verification of the backend's certificate for "https" and "tls" checks.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	// Rise is the number of consecutive successful checks needed for an unhealthy backend to become healthy. Defaults
+	// to 1.
+	Rise int `json:"rise,omitempty" yaml:"rise,omitempty"`
+	// Fall is the number of consecutive failed checks needed for a healthy backend to become unhealthy. Defaults to 1.
+	Fall int `json:"fall,omitempty" yaml:"fall,omitempty"`
+	// Timeout is the time after which a check is aborted and considered failed. Defaults to the health interval.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Jitter is the maximum random delay added to the health interval so that checks of many backends don't happen
+	// at the same time. Defaults to a tenth of the health interval.
+	Jitter time.Duration `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+}
+
+// OutlierDetection represents the configuration of the passive health checking of backends. Connections that are
+// reset by the backend, that the backend closes without sending any data or, if FirstByteTimeout is set, that the
+// backend doesn't respond to in time count as failures, as do failed connection attempts. A backend is ejected after
+// ConsecutiveFailures failures in a row and doesn't receive new connections until the ejection time has passed. The
+// ejection time doubles with each consecutive ejection.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of failures in a row after which a backend is ejected. Defaults to 5.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty" yaml:"consecutiveFailures,omitempty"`
+	// BaseEjectionTime is the duration of the first ejection. Defaults to 30s.
+	BaseEjectionTime time.Duration `json:"base_ejection_time,omitempty" yaml:"baseEjectionTime,omitempty"`
+	// MaxEjectionTime caps the ejection time. Defaults to 5m.
+	MaxEjectionTime time.Duration `json:"max_ejection_time,omitempty" yaml:"maxEjectionTime,omitempty"`
+	// FirstByteTimeout makes connections count as failures if the backend takes longer to respond to the first data
+	// sent by the client. Disabled by default.
+	FirstByteTimeout time.Duration `json:"first_byte_timeout,omitempty" yaml:"firstByteTimeout,omitempty"`
+}
+
+// Read reads a [Config] from the given file. A non-nil error is returned when the file can't be opened, its format is
+// unrecognized or it contains unknown settings. The configuration isn't validated, see [Config.Validate]; problems
+// found by validating it refer to the file's lines.
 func Read(cfgPath string) (*Config, error) {
 	//gosec:disable G304 -- cfgPath is provided by the caller and is expected to be a trusted configuration file path
 	cfgBytes, err := os.ReadFile(cfgPath)
@@ -46,10 +310,31 @@ func Read(cfgPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read configuration file %q: %w", cfgPath, err)
 	}
 
-	var cfg Config
-	if err := yaml.Unmarshal(cfgBytes, &cfg); err != nil {
+	cfg, err := Parse(cfgBytes)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse configuration file %q: %w", cfgPath, err)
 	}
+	cfg.file = cfgPath
+
+	return cfg, nil
+}
+
+// Parse parses a [Config] from YAML. Unknown settings are rejected so that typos don't go unnoticed.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	// an empty document results in an empty configuration, which is reported by Validate.
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	cfg.positions = make(positions)
+	cfg.positions.collect(&root, "")
 
 	return &cfg, nil
 }
@@ -0,0 +1,171 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/config"
+)
+
+func TestReadRejectsUnknownSettings(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "l4proxy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backend:
+      - address: 10.0.0.100:80
+`), 0o600))
+
+	_, err := config.Read(path)
+	require.ErrorContains(t, err, "line 5: field backend not found")
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Read("../l4proxy_example.yaml")
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "l4proxy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:80
+      - address: 10.0.0.100
+  - bind: :80
+    balance: fastest
+    backends:
+      - address: 10.0.0.101:80
+  - bind: :80
+    protocol: udp
+    healthInterval: 5
+    sniRouting: true
+`), 0o600))
+
+	cfg, err := config.Read(path)
+	require.NoError(t, err)
+	err = cfg.Validate()
+	var vErr *config.ValidationError
+	require.ErrorAs(t, err, &vErr)
+
+	problems := make([]string, len(vErr.Problems))
+	for idx, p := range vErr.Problems {
+		problems[idx] = p.String()
+	}
+	require.Equal(t, []string{
+		path + ": apiVersion: apiVersion is required",
+		path + `:6: frontends[0].backends[1].address: invalid address: invalid port "10.0.0.100", expected [host:]port`,
+		path + ":7: frontends[1].healthInterval: healthInterval must be a positive number of seconds",
+		path + `:8: frontends[1].balance: unknown balancing strategy "fastest"`,
+		path + `:7: frontends[1].bind: tcp4 address ":80" is already bound by frontends[0] in line 2`,
+		path + ":14: frontends[2].sniRouting: sniRouting is only supported for TCP",
+	}, problems)
+}
+
+func TestValidateAcceptsConfigsNotReadFromFiles(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends:  []config.Frontend{{Bind: ":80", HealthInterval: 5}, {Bind: ":80", HealthInterval: 0}},
+	}
+	require.EqualError(t, cfg.Validate(), "invalid configuration: "+
+		"frontends[1].healthInterval: healthInterval must be a positive number of seconds; "+
+		`frontends[1].bind: tcp4 address ":80" is already bound by frontends[0]`)
+}
+
+func TestValidateReportsOverlappingBinds(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{
+			{Bind: ":80", HealthInterval: 5},
+			{Bind: "0.0.0.0:80", HealthInterval: 5},
+			{Bind: "127.0.0.1:80", HealthInterval: 5},
+			{Bind: "443", HealthInterval: 5, Family: config.FamilyDual},
+			{Bind: "[::]:443", HealthInterval: 5, Family: config.FamilyIPv6},
+			{Bind: "10.0.0.1:443", HealthInterval: 5},
+			// different hosts, protocols and families without overlap don't conflict.
+			{Bind: "127.0.0.1:8080", HealthInterval: 5},
+			{Bind: "127.0.0.2:8080", HealthInterval: 5},
+			{Bind: ":80", HealthInterval: 5, Protocol: config.ProtocolUDP},
+			{Bind: ":80", HealthInterval: 5, Family: config.FamilyIPv6},
+			{Bind: "[::1]:80", HealthInterval: 5, Family: config.FamilyIPv6},
+		},
+	}
+	require.EqualError(t, cfg.Validate(), "invalid configuration: "+
+		`frontends[1].bind: tcp4 address "0.0.0.0:80" is already bound by frontends[0]; `+
+		`frontends[2].bind: tcp4 address "127.0.0.1:80" overlaps with tcp4 address ":80" bound by frontends[0]; `+
+		`frontends[4].bind: tcp6 address "[::]:443" overlaps with tcp address "443" bound by frontends[3]; `+
+		`frontends[5].bind: tcp4 address "10.0.0.1:443" overlaps with tcp address "443" bound by frontends[3]; `+
+		`frontends[10].bind: tcp6 address "[::1]:80" overlaps with tcp6 address ":80" bound by frontends[9]`)
+}
+
+func TestValidateChecksTLSSettingsAndHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(cert, []byte("cert"), 0o600))
+	missing := filepath.Join(dir, "missing.pem")
+
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{
+			{
+				Bind:           ":443",
+				HealthInterval: 5,
+				TLS: &config.TLS{
+					CertFile:     cert,
+					KeyFile:      missing,
+					CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_BOGUS", "TLS_RSA_WITH_RC4_128_SHA"},
+				},
+				BackendTLS: &config.BackendTLS{CAFile: missing},
+			},
+			{
+				Bind:           ":53",
+				Protocol:       config.ProtocolUDP,
+				HealthInterval: 5,
+				HealthCheck:    &config.HealthCheck{Type: config.HealthCheckHTTP},
+				Backends: []config.Backend{
+					{Address: "10.0.0.53:53", HealthCheck: &config.HealthCheck{Type: config.HealthCheckTCP}},
+					{Address: "10.0.0.54:53", HealthCheck: &config.HealthCheck{Type: config.HealthCheckTLS}},
+				},
+			},
+		},
+	}
+	require.EqualError(t, cfg.Validate(), "invalid configuration: "+
+		"frontends[0].tls.keyFile: open "+missing+": no such file or directory; "+
+		`frontends[0].tls.cipherSuites[1]: unknown or insecure cipher suite "TLS_BOGUS"; `+
+		`frontends[0].tls.cipherSuites[2]: unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"; `+
+		"frontends[0].backendTLS.caFile: open "+missing+": no such file or directory; "+
+		`frontends[1].healthCheck.type: health check type "http" is not supported for UDP; `+
+		`frontends[1].backends[1].healthCheck.type: health check type "tls" is not supported for UDP`)
+}
+
+func TestValidateAcceptsPortOnlyAddresses(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends: []config.Frontend{{
+			Bind:           "80",
+			HealthInterval: 5,
+			Backends:       []config.Backend{{Address: "8080"}, {Address: ":8081"}, {Address: "localhost:8082"}},
+		}},
+	}
+	require.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Merge merges configurations, e.g. read from several files, into a single one. Frontends with the same protocol,
+// address family and bind address are merged into one frontend serving the backends of all of them if their other
+// settings are the same. Bind addresses are compared after normalizing them, so ":80" and "0.0.0.0:80" are the same.
+// Frontends with different but overlapping addresses, e.g. ":80" and "127.0.0.1:80", conflict, as do backends with the
+// same address but different settings. The global Allow and Deny settings of each configuration are applied to its
+// own frontends only.
+//
+// The configurations should have been validated, see [Config.Validate]. A [*ValidationError] naming both definitions
+// is returned for each conflict.
+func Merge(cfgs ...*Config) (*Config, error) {
+	m := &merger{merged: &Config{APIVersion: APIVersionV1}}
+	for _, cfg := range cfgs {
+		for idx, fe := range cfg.Frontends {
+			if fe.Allow == nil {
+				fe.Allow = cfg.Allow
+			}
+			if fe.Deny == nil {
+				fe.Deny = cfg.Deny
+			}
+			m.add(cfg, fmt.Sprintf("frontends[%d]", idx), fe)
+		}
+	}
+
+	if len(m.problems) > 0 {
+		return nil, &ValidationError{Problems: m.problems}
+	}
+	return m.merged, nil
+}
+
+// merger merges frontends into a configuration.
+type merger struct {
+	merged *Config
+	// addrs holds the listen addresses of the merged frontends and origins where they have been defined first.
+	addrs    []listenAddr
+	origins  []string
+	problems []Problem
+}
+
+// add merges the frontend at path of cfg.
+func (m *merger) add(cfg *Config, path string, fe Frontend) {
+	addr, err := parseListenAddr(fe)
+	if err != nil {
+		// the frontend fails to start anyway, it's only merged with frontends spelled the same way.
+		addr = listenAddr{network: fe.Protocol + "/" + fe.Family, host: fe.Bind, unparsed: true}
+	}
+
+	mIdx := slices.Index(m.addrs, addr)
+	if mIdx < 0 {
+		if other := slices.IndexFunc(m.addrs, addr.overlaps); other >= 0 {
+			m.problems = append(m.problems, cfg.problem(path+".bind", "frontend %s overlaps with frontend %s defined in %s",
+				addr, m.addrs[other], m.origins[other]))
+			return
+		}
+		m.addrs = append(m.addrs, addr)
+		m.origins = append(m.origins, cfg.location(path))
+		fe.Backends = slices.Clone(fe.Backends)
+		m.merged.Frontends = append(m.merged.Frontends, fe)
+		return
+	}
+
+	existing := &m.merged.Frontends[mIdx]
+	if !sameFrontendSettings(*existing, fe) {
+		m.problems = append(m.problems, cfg.problem(path, "frontend %s conflicts with the one defined in %s: "+
+			"frontends binding the same address must only differ in their backends", addr, m.origins[mIdx]))
+		return
+	}
+	for bIdx, be := range fe.Backends {
+		i := slices.IndexFunc(existing.Backends, func(o Backend) bool { return o.Address == be.Address })
+		if i < 0 {
+			existing.Backends = append(existing.Backends, be)
+			continue
+		}
+		if !reflect.DeepEqual(existing.Backends[i], be) {
+			m.problems = append(m.problems, cfg.problem(fmt.Sprintf("%s.backends[%d]", path, bIdx),
+				"backend %q of frontend %s conflicts with the one defined for the frontend in %s", be.Address, addr,
+				m.origins[mIdx]))
+		}
+	}
+}
+
+// sameFrontendSettings reports whether two frontends with the same listen address only differ in their backends.
+// Their bind addresses, protocols and families may be spelled differently.
+func sameFrontendSettings(a, b Frontend) bool {
+	a.Backends, b.Backends = nil, nil
+	a.Bind, b.Bind = "", ""
+	a.Protocol, b.Protocol = "", ""
+	a.Family, b.Family = "", ""
+	return reflect.DeepEqual(a, b)
+}
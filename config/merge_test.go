@@ -0,0 +1,183 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/config"
+)
+
+// readConfig writes the given configuration to a file in dir and reads it.
+func readConfig(t *testing.T, dir, name, content string) *config.Config {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	cfg, err := config.Read(path)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	return cfg
+}
+
+func TestMergeUnitesBackendsOfIdenticalFrontends(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	announced := readConfig(t, dir, "announced.yaml", `apiVersion: v1
+deny: [192.0.2.0/24]
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:80
+      - address: 10.0.0.101:80
+  - bind: :53
+    protocol: udp
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:53
+`)
+	static := readConfig(t, dir, "static.yaml", `apiVersion: v1
+deny: [192.0.2.0/24]
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.101:80
+      - address: 10.0.0.102:80
+  - bind: :53
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.103:53
+`)
+
+	merged, err := config.Merge(announced, static)
+	require.NoError(t, err)
+	require.Equal(t, []config.Frontend{
+		{
+			Bind:           ":80",
+			HealthInterval: 5,
+			Deny:           []string{"192.0.2.0/24"},
+			Backends: []config.Backend{
+				{Address: "10.0.0.100:80"},
+				{Address: "10.0.0.101:80"},
+				{Address: "10.0.0.102:80"},
+			},
+		},
+		{
+			Bind:           ":53",
+			Protocol:       "udp",
+			HealthInterval: 5,
+			Deny:           []string{"192.0.2.0/24"},
+			Backends:       []config.Backend{{Address: "10.0.0.100:53"}},
+		},
+		{
+			Bind:           ":53",
+			HealthInterval: 5,
+			Deny:           []string{"192.0.2.0/24"},
+			Backends:       []config.Backend{{Address: "10.0.0.103:53"}},
+		},
+	}, merged.Frontends)
+	require.Len(t, announced.Frontends[0].Backends, 2, "merging must not change the merged configurations")
+}
+
+func TestMergeReportsConflicts(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	first := readConfig(t, dir, "first.yaml", `apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:80
+  - bind: :443
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:443
+`)
+	second := readConfig(t, dir, "second.yaml", `apiVersion: v1
+frontends:
+  - bind: :80
+    healthInterval: 10
+    backends:
+      - address: 10.0.0.101:80
+  - bind: :443
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:443
+        weight: 2
+`)
+
+	_, err := config.Merge(first, second)
+	var vErr *config.ValidationError
+	require.ErrorAs(t, err, &vErr)
+	problems := make([]string, len(vErr.Problems))
+	for idx, p := range vErr.Problems {
+		problems[idx] = p.String()
+	}
+	secondPath, firstPath := filepath.Join(dir, "second.yaml"), filepath.Join(dir, "first.yaml")
+	require.Equal(t, []string{
+		secondPath + ":3: frontends[0]: frontend tcp4/:80 conflicts with the one defined in " + firstPath + ":3: " +
+			"frontends binding the same address must only differ in their backends",
+		secondPath + ":10: frontends[1].backends[0]: backend \"10.0.0.100:443\" of frontend tcp4/:443 conflicts with " +
+			"the one defined for the frontend in " + firstPath + ":7",
+	}, problems)
+}
+
+func TestMergeNormalizesBindAddresses(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	first := readConfig(t, dir, "first.yaml", `apiVersion: v1
+frontends:
+  - bind: :443
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.100:443
+  - bind: :80
+    healthInterval: 5
+`)
+	second := readConfig(t, dir, "second.yaml", `apiVersion: v1
+frontends:
+  - bind: 0.0.0.0:443
+    family: ipv4
+    healthInterval: 5
+    backends:
+      - address: 10.0.0.101:443
+`)
+	merged, err := config.Merge(first, second)
+	require.NoError(t, err)
+	require.Len(t, merged.Frontends, 2)
+	require.Equal(t, []config.Backend{{Address: "10.0.0.100:443"}, {Address: "10.0.0.101:443"}}, merged.Frontends[0].Backends)
+
+	third := readConfig(t, dir, "third.yaml", `apiVersion: v1
+frontends:
+  - bind: 127.0.0.1:80
+    healthInterval: 5
+  - bind: "443"
+    family: dual
+    healthInterval: 5
+`)
+	_, err = config.Merge(first, third)
+	thirdPath, firstPath := filepath.Join(dir, "third.yaml"), filepath.Join(dir, "first.yaml")
+	require.EqualError(t, err, "invalid configuration: "+
+		thirdPath+":3: frontends[0].bind: frontend tcp4/127.0.0.1:80 overlaps with frontend tcp4/:80 defined in "+firstPath+":7; "+
+		thirdPath+":5: frontends[1].bind: frontend tcp/:443 overlaps with frontend tcp4/:443 defined in "+firstPath+":3")
+}
+
+func TestMergeKeepsFrontendsWithUnparsableBinds(t *testing.T) {
+	t.Parallel()
+
+	merged, err := config.Merge(&config.Config{
+		APIVersion: config.APIVersionV1,
+		Frontends:  []config.Frontend{{Bind: "foo"}, {Bind: "bar"}, {Bind: "foo"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, merged.Frontends, 2)
+	require.Equal(t, "foo", merged.Frontends[0].Bind)
+	require.Equal(t, "bar", merged.Frontends[1].Bind)
+}
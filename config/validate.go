@@ -0,0 +1,418 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a single problem found by [Config.Validate].
+type Problem struct {
+	// File and Line locate the problem. File is empty if the configuration hasn't been read from a file. Line points
+	// to the problematic setting or, if it is missing, to the closest enclosing setting. It is zero if unknown.
+	File string
+	Line int
+	// Path is the path of the problematic setting, e.g. "frontends[0].backends[1].address".
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.File != "" {
+		b.WriteString(p.File)
+		if p.Line > 0 {
+			fmt.Fprintf(&b, ":%d", p.Line)
+		}
+		b.WriteString(": ")
+	}
+	b.WriteString(p.Path + ": " + p.Message)
+	return b.String()
+}
+
+// ValidationError is returned by [Config.Validate]. It holds all problems found.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for idx, p := range e.Problems {
+		problems[idx] = p.String()
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+// positions maps the paths of the settings in a configuration file to the lines they are defined in. See
+// [Problem.Path] for the format.
+type positions map[string]int
+
+func (p positions) collect(node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			p.collect(child, path)
+		}
+	case yaml.MappingNode:
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			key := node.Content[idx].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			p[key] = node.Content[idx].Line
+			p.collect(node.Content[idx+1], key)
+		}
+	case yaml.SequenceNode:
+		for idx, item := range node.Content {
+			key := fmt.Sprintf("%s[%d]", path, idx)
+			p[key] = item.Line
+			p.collect(item, key)
+		}
+	}
+}
+
+// line returns the line of the setting at path or, if it is missing, of the closest enclosing setting.
+func (p positions) line(path string) int {
+	for path != "" {
+		if line, ok := p[path]; ok {
+			return line
+		}
+		idx := strings.LastIndexAny(path, ".[")
+		if idx < 0 {
+			break
+		}
+		path = path[:idx]
+	}
+	return 0
+}
+
+// validator collects the problems of a configuration.
+type validator struct {
+	cfg      *Config
+	problems []Problem
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.problems = append(v.problems, v.cfg.problem(path, format, args...))
+}
+
+// Validate checks the configuration for problems that would make l4proxy fail to apply it or apply it differently
+// than intended, e.g. missing settings, invalid values and frontends binding the same address twice. Files that are
+// referenced by the configuration, like certificates, must be readable but their contents are not checked. It returns
+// a [*ValidationError] holding all problems found or nil if the configuration is valid.
+func (c *Config) Validate() error {
+	v := &validator{cfg: c}
+
+	switch c.APIVersion {
+	case APIVersionV1:
+	case "":
+		v.addf("apiVersion", "apiVersion is required")
+	default:
+		v.addf("apiVersion", "unsupported API version %q, expected %q", c.APIVersion, APIVersionV1)
+	}
+	v.prefixes("allow", c.Allow)
+	v.prefixes("deny", c.Deny)
+
+	// frontends conflict if their listeners can't exist at the same time, e.g. ":80" and "0.0.0.0:80" or an IPv4 and
+	// a dual-stack listener on the same port.
+	addrs := make([]listenAddr, len(c.Frontends))
+	for idx, fe := range c.Frontends {
+		path := fmt.Sprintf("frontends[%d]", idx)
+		v.frontend(path, fe)
+		v.bind(path, idx, addrs)
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// lineSuffix returns a reference to the line of the setting at path for messages or an empty string if unknown.
+func (c *Config) lineSuffix(path string) string {
+	if line := c.positions.line(path); line > 0 {
+		return fmt.Sprintf(" in line %d", line)
+	}
+	return ""
+}
+
+// problem returns a problem with the setting at path.
+func (c *Config) problem(path, format string, args ...any) Problem {
+	return Problem{File: c.file, Line: c.positions.line(path), Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// location describes where the setting at path is defined for messages, e.g. "l4proxy.yaml:12".
+func (c *Config) location(path string) string {
+	switch line := c.positions.line(path); {
+	case c.file == "":
+		return path
+	case line > 0:
+		return fmt.Sprintf("%s:%d", c.file, line)
+	default:
+		return c.file + " (" + path + ")"
+	}
+}
+
+// bind reports an invalid bind address of the frontend at idx and conflicts with the frontends before it. It stores
+// the frontend's listen address in addrs.
+func (v *validator) bind(path string, idx int, addrs []listenAddr) {
+	fe := v.cfg.Frontends[idx]
+	if fe.Bind == "" {
+		return
+	}
+	addr, err := parseListenAddr(fe)
+	if err != nil {
+		// unsupported protocols and families are reported by frontend.
+		if _, nwErr := Network(fe.Protocol, fe.Family); nwErr == nil {
+			v.addf(path+".bind", "invalid bind %q: %s", fe.Bind, err)
+		}
+		return
+	}
+	addrs[idx] = addr
+
+	for other := range idx {
+		if addrs[other].network == "" || !addr.overlaps(addrs[other]) {
+			continue
+		}
+		otherPath := fmt.Sprintf("frontends[%d]", other)
+		if addr == addrs[other] {
+			v.addf(path+".bind", "%s address %q is already bound by %s%s", addr.network, fe.Bind, otherPath,
+				v.cfg.lineSuffix(otherPath))
+		} else {
+			v.addf(path+".bind", "%s address %q overlaps with %s address %q bound by %s%s", addr.network, fe.Bind,
+				addrs[other].network, v.cfg.Frontends[other].Bind, otherPath, v.cfg.lineSuffix(otherPath))
+		}
+		return
+	}
+}
+
+func (v *validator) frontend(path string, fe Frontend) {
+	if fe.Bind == "" {
+		v.addf(path+".bind", "bind is required")
+	}
+	if _, err := Network(fe.Protocol, fe.Family); err != nil {
+		v.addf(path, "%s", err)
+	}
+	if fe.HealthInterval <= 0 {
+		v.addf(path+".healthInterval", "healthInterval must be a positive number of seconds")
+	}
+	if !slices.Contains([]string{"", BalanceRandom, BalanceRoundRobin, BalanceWeightedRoundRobin, BalanceLeastConnections},
+		fe.Balance) {
+		v.addf(path+".balance", "unknown balancing strategy %q", fe.Balance)
+	}
+	v.proxyProtocol(path+".sendProxyProtocol", fe.SendProxyProtocol)
+	if fe.Retries != nil {
+		v.nonNegative(path, setting{"retries", float64(*fe.Retries)})
+	}
+	v.nonNegative(path,
+		duration("timeout", fe.Timeout),
+		duration("drainTimeout", fe.DrainTimeout),
+		duration("connectTimeout", fe.ConnectTimeout),
+		duration("idleTimeout", fe.IdleTimeout),
+		duration("clientIdleTimeout", fe.ClientIdleTimeout),
+		duration("backendIdleTimeout", fe.BackendIdleTimeout),
+		duration("maxConnectionLifetime", fe.MaxConnectionLifetime),
+	)
+	v.prefixes(path+".trustedProxies", fe.TrustedProxies)
+	v.prefixes(path+".allow", fe.Allow)
+	v.prefixes(path+".deny", fe.Deny)
+	v.tcpOnly(path, fe)
+	v.limits(path+".limits", fe.Limits)
+	v.tls(path+".tls", fe.TLS)
+	v.backendTLS(path+".backendTLS", fe.BackendTLS)
+	v.healthCheck(path+".healthCheck", fe.Protocol, fe.HealthCheck)
+	v.outlierDetection(path+".outlierDetection", fe.OutlierDetection)
+	if fe.AccessLog != nil && fe.AccessLog.Path == "" {
+		v.addf(path+".accessLog.path", "path is required")
+	}
+
+	addresses := make(map[string]int, len(fe.Backends))
+	for idx, be := range fe.Backends {
+		bePath := fmt.Sprintf("%s.backends[%d]", path, idx)
+		v.backend(bePath, fe, be)
+		if other, ok := addresses[be.Address]; ok && be.Address != "" {
+			v.addf(bePath+".address", "backend %q is already defined by %s.backends[%d]", be.Address, path, other)
+			continue
+		}
+		addresses[be.Address] = idx
+	}
+}
+
+// tcpOnly reports the settings of a UDP frontend that are only supported for TCP.
+func (v *validator) tcpOnly(path string, fe Frontend) {
+	if fe.Protocol != ProtocolUDP {
+		return
+	}
+	for _, s := range []struct {
+		name string
+		set  bool
+	}{
+		{"acceptProxyProtocol", fe.AcceptProxyProtocol},
+		{"sendProxyProtocol", fe.SendProxyProtocol != ""},
+		{"sniRouting", fe.SNIRouting},
+		{"tls", fe.TLS != nil},
+		{"backendTLS", fe.BackendTLS != nil},
+	} {
+		if s.set {
+			v.addf(path+"."+s.name, "%s is only supported for TCP", s.name)
+		}
+	}
+}
+
+func (v *validator) backend(path string, fe Frontend, be Backend) {
+	if be.Address == "" {
+		v.addf(path+".address", "address is required")
+	} else if _, _, err := splitHostPort(be.Address, fe.Protocol); err != nil {
+		v.addf(path+".address", "invalid address: %s", err)
+	}
+	v.nonNegative(path, setting{"weight", float64(be.Weight)}, setting{"maxConnections", float64(be.MaxConnections)})
+	v.proxyProtocol(path+".sendProxyProtocol", be.SendProxyProtocol)
+	if len(be.ServerNames) > 0 && !fe.SNIRouting {
+		v.addf(path+".serverNames", "serverNames are only supported on frontends with sniRouting enabled")
+	}
+	if fe.Protocol == ProtocolUDP {
+		if be.SendProxyProtocol != "" {
+			v.addf(path+".sendProxyProtocol", "sendProxyProtocol is only supported for TCP")
+		}
+		if be.TLS != nil {
+			v.addf(path+".tls", "tls is only supported for TCP")
+		}
+	}
+	v.backendTLS(path+".tls", be.TLS)
+	v.healthCheck(path+".healthCheck", fe.Protocol, be.HealthCheck)
+}
+
+func (v *validator) proxyProtocol(path, version string) {
+	if !slices.Contains([]string{"", ProxyProtocolV1, ProxyProtocolV2}, version) {
+		v.addf(path, "unknown PROXY protocol version %q, expected one of %s, %s", version, ProxyProtocolV1, ProxyProtocolV2)
+	}
+}
+
+func (v *validator) limits(path string, l *Limits) {
+	if l == nil {
+		return
+	}
+	v.nonNegative(path,
+		setting{"maxConnections", float64(l.MaxConnections)},
+		duration("queueTimeout", l.QueueTimeout),
+		setting{"maxConnectionsPerSource", float64(l.MaxConnectionsPerSource)},
+		setting{"ratePerSource", l.RatePerSource},
+		setting{"burstPerSource", float64(l.BurstPerSource)},
+	)
+}
+
+func (v *validator) tls(path string, t *TLS) {
+	if t == nil {
+		return
+	}
+	if t.CertFile == "" {
+		v.addf(path+".certFile", "certFile is required")
+	}
+	if t.KeyFile == "" {
+		v.addf(path+".keyFile", "keyFile is required")
+	}
+	v.readable(path+".certFile", t.CertFile)
+	v.readable(path+".keyFile", t.KeyFile)
+	v.readable(path+".clientCAFile", t.ClientCAFile)
+	if !slices.Contains([]string{"", TLSVersion10, TLSVersion11, TLSVersion12, TLSVersion13}, t.MinVersion) {
+		v.addf(path+".minVersion", "unknown TLS version %q, expected one of %s, %s, %s, %s",
+			t.MinVersion, TLSVersion10, TLSVersion11, TLSVersion12, TLSVersion13)
+	}
+	// only suites without known security issues are supported, just like when the frontend is started.
+	for idx, name := range t.CipherSuites {
+		if !slices.ContainsFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name }) {
+			v.addf(fmt.Sprintf("%s.cipherSuites[%d]", path, idx), "unknown or insecure cipher suite %q", name)
+		}
+	}
+}
+
+func (v *validator) backendTLS(path string, t *BackendTLS) {
+	if t == nil {
+		return
+	}
+	v.readable(path+".caFile", t.CAFile)
+}
+
+// readable reports the file at path of the setting at settingPath if it can't be read. An empty path is ignored.
+func (v *validator) readable(settingPath, path string) {
+	if path == "" {
+		return
+	}
+	//gosec:disable G304 -- the files are referenced by the configuration which is trusted
+	f, err := os.Open(path)
+	if err != nil {
+		v.addf(settingPath, "%s", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		v.addf(settingPath, "%s", err)
+	}
+}
+
+func (v *validator) healthCheck(path, protocol string, hc *HealthCheck) {
+	if hc == nil {
+		return
+	}
+	switch {
+	case !slices.Contains([]string{"", HealthCheckTCP, HealthCheckHTTP, HealthCheckHTTPS, HealthCheckTLS}, hc.Type):
+		v.addf(path+".type", "unknown health check type %q, expected one of %s, %s, %s, %s",
+			hc.Type, HealthCheckTCP, HealthCheckHTTP, HealthCheckHTTPS, HealthCheckTLS)
+	case protocol == ProtocolUDP && hc.Type != "" && hc.Type != HealthCheckTCP:
+		v.addf(path+".type", "health check type %q is not supported for UDP", hc.Type)
+	}
+	v.nonNegative(path,
+		setting{"rise", float64(hc.Rise)},
+		setting{"fall", float64(hc.Fall)},
+		duration("timeout", hc.Timeout),
+		duration("jitter", hc.Jitter),
+	)
+}
+
+func (v *validator) outlierDetection(path string, od *OutlierDetection) {
+	if od == nil {
+		return
+	}
+	v.nonNegative(path,
+		setting{"consecutiveFailures", float64(od.ConsecutiveFailures)},
+		duration("baseEjectionTime", od.BaseEjectionTime),
+		duration("maxEjectionTime", od.MaxEjectionTime),
+		duration("firstByteTimeout", od.FirstByteTimeout),
+	)
+}
+
+// setting is a numeric setting checked by [validator.nonNegative].
+type setting struct {
+	name  string
+	value float64
+}
+
+func duration(name string, d time.Duration) setting {
+	return setting{name, float64(d)}
+}
+
+// nonNegative reports the negative settings below path.
+func (v *validator) nonNegative(path string, settings ...setting) {
+	for _, s := range settings {
+		if s.value < 0 {
+			v.addf(path+"."+s.name, "%s must not be negative", s.name)
+		}
+	}
+}
+
+// prefixes reports the entries of a list of IP addresses and CIDR networks that can't be parsed.
+func (v *validator) prefixes(path string, specs []string) {
+	for idx, spec := range specs {
+		if _, err := netip.ParseAddr(spec); err == nil {
+			continue
+		}
+		if _, err := netip.ParsePrefix(spec); err != nil {
+			v.addf(fmt.Sprintf("%s[%d]", path, idx), "%q is neither an IP address nor a CIDR network", spec)
+		}
+	}
+}
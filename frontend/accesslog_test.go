@@ -0,0 +1,91 @@
+package frontend_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/accesslog"
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+	"github.com/makkes/l4proxy/metrics"
+)
+
+// syncBuffer is a buffer that can be written to by a frontend while a test reads from it.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries returns the access log entries written so far.
+func (b *syncBuffer) entries(t *testing.T) []map[string]any {
+	t.Helper()
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	var res []map[string]any
+	for line := range bytes.Lines(b.buf.Bytes()) {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(line, &entry))
+		res = append(res, entry)
+	}
+	return res
+}
+
+func TestAccessLogRecordsProxiedConnections(t *testing.T) {
+	t.Parallel()
+
+	var buf syncBuffer
+	fe := startTCPFrontend(t, frontend.WithAccessLog(accesslog.New(&buf)))
+	t.Cleanup(fe.Stop)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, conn, "hello")
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool { return len(buf.entries(t)) == 1 }, 3*time.Second, 10*time.Millisecond)
+	entry := buf.entries(t)[0]
+	require.Equal(t, fe.Name(), entry["frontend"])
+	require.Equal(t, conn.LocalAddr().String(), entry["client"])
+	require.Equal(t, fe.Backends[0].Addr, entry["backend"])
+	require.Equal(t, string(backend.CloseClientEOF), entry["close_reason"])
+	require.InDelta(t, 5, entry["bytes_to_backend"], 0)
+	require.InDelta(t, 5, entry["bytes_to_client"], 0)
+	require.InDelta(t, 0, entry["retries"], 0)
+	require.Positive(t, entry["connect_seconds"])
+	require.Positive(t, entry["duration_seconds"])
+}
+
+func TestAccessLogRecordsRejectedConnections(t *testing.T) {
+	t.Parallel()
+
+	var buf syncBuffer
+	fe := startTCPFrontend(t,
+		frontend.WithAccessLog(accesslog.New(&buf)),
+		frontend.WithDeniedSources([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}),
+	)
+	t.Cleanup(fe.Stop)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	requireClosed(t, conn)
+
+	require.Eventually(t, func() bool { return len(buf.entries(t)) == 1 }, 3*time.Second, 10*time.Millisecond)
+	entry := buf.entries(t)[0]
+	require.Equal(t, conn.LocalAddr().String(), entry["client"])
+	require.Equal(t, metrics.ReasonDenied, entry["close_reason"])
+	require.NotContains(t, entry, "backend")
+}
@@ -0,0 +1,154 @@
+package frontend
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/makkes/l4proxy/backend"
+)
+
+// Names of the load-balancing strategies supported by [NewBalancer].
+const (
+	BalanceRandom             = "random"
+	BalanceRoundRobin         = "round-robin"
+	BalanceWeightedRoundRobin = "weighted-round-robin"
+	BalanceLeastConnections   = "least-connections"
+)
+
+// Balancer decides which backend serves a new connection.
+type Balancer interface {
+	// Order returns the given backends in the order in which they should be tried for a new connection. Implementations
+	// must not modify the passed slice.
+	Order(backends []*backend.Backend) []*backend.Backend
+}
+
+// backendForgetter is implemented by balancers keeping state per backend. The frontend calls forget when a backend is
+// removed so that the state doesn't pile up.
+type backendForgetter interface {
+	forget(be *backend.Backend)
+}
+
+// NewBalancer returns the [Balancer] implementing the strategy with the given name. An empty name selects
+// [BalanceRandom].
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", BalanceRandom:
+		return &RandomBalancer{}, nil
+	case BalanceRoundRobin:
+		return &RoundRobinBalancer{}, nil
+	case BalanceWeightedRoundRobin:
+		return &WeightedRoundRobinBalancer{}, nil
+	case BalanceLeastConnections:
+		return &LeastConnectionsBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", name)
+	}
+}
+
+// RandomBalancer tries backends in random order.
+type RandomBalancer struct{}
+
+// Order implements [Balancer].
+func (*RandomBalancer) Order(backends []*backend.Backend) []*backend.Backend {
+	res := slices.Clone(backends)
+	rand.Shuffle(len(res), func(i, j int) {
+		res[i], res[j] = res[j], res[i]
+	})
+	return res
+}
+
+// RoundRobinBalancer hands out backends in turn, starting with the next backend on each call.
+type RoundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+// Order implements [Balancer].
+func (b *RoundRobinBalancer) Order(backends []*backend.Backend) []*backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	start := int((b.next.Add(1) - 1) % uint64(len(backends))) //nolint:gosec // the modulo keeps the value within int range
+	res := make([]*backend.Backend, 0, len(backends))
+	res = append(res, backends[start:]...)
+	return append(res, backends[:start]...)
+}
+
+// WeightedRoundRobinBalancer hands out backends in turn, proportionally to their weight. It implements the smooth
+// weighted round-robin algorithm so that heavier backends are interleaved with lighter ones instead of being picked in
+// bursts. Backends with a weight <= 0 are treated as having a weight of 1.
+//
+// The state of each backend is kept across calls, even if it isn't part of the backends passed in, e.g. because it is
+// unhealthy or doesn't serve the requested server name, so that the weights hold for any subset of the backends.
+type WeightedRoundRobinBalancer struct {
+	mux     sync.Mutex
+	current map[*backend.Backend]int
+}
+
+// Order implements [Balancer].
+func (b *WeightedRoundRobinBalancer) Order(backends []*backend.Backend) []*backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.current == nil {
+		b.current = make(map[*backend.Backend]int, len(backends))
+	}
+
+	total := 0
+	selected := 0
+	for idx, be := range backends {
+		w := weight(be)
+		total += w
+		b.current[be] += w
+		if b.current[be] > b.current[backends[selected]] {
+			selected = idx
+		}
+	}
+	b.current[backends[selected]] -= total
+
+	res := make([]*backend.Backend, 0, len(backends))
+	res = append(res, backends[selected])
+	for idx, be := range backends {
+		if idx != selected {
+			res = append(res, be)
+		}
+	}
+	return res
+}
+
+func (b *WeightedRoundRobinBalancer) forget(be *backend.Backend) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.current, be)
+}
+
+func weight(be *backend.Backend) int {
+	if be.Weight <= 0 {
+		return 1
+	}
+	return be.Weight
+}
+
+// LeastConnectionsBalancer prefers the backends with the fewest active connections. Backends with the same number of
+// active connections are tried in random order.
+type LeastConnectionsBalancer struct{}
+
+// Order implements [Balancer].
+func (*LeastConnectionsBalancer) Order(backends []*backend.Backend) []*backend.Backend {
+	res := (&RandomBalancer{}).Order(backends)
+	conns := make(map[*backend.Backend]int64, len(res))
+	for _, be := range res {
+		conns[be] = be.ActiveConns()
+	}
+	slices.SortStableFunc(res, func(a, b *backend.Backend) int {
+		return cmp.Compare(conns[a], conns[b])
+	})
+	return res
+}
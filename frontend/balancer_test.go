@@ -0,0 +1,109 @@
+package frontend_test
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+)
+
+func testBackends(weights ...int) []*backend.Backend {
+	res := make([]*backend.Backend, 0, len(weights))
+	for _, w := range weights {
+		res = append(res, backend.NewBackend("tcp4", "127.0.0.1:1", logr.Discard(), backend.WithWeight(w)))
+	}
+	return res
+}
+
+func TestNewBalancerRejectsUnknownStrategy(t *testing.T) {
+	t.Parallel()
+
+	_, err := frontend.NewBalancer("foobar")
+	require.Error(t, err)
+}
+
+func TestNewBalancerDefaultsToRandom(t *testing.T) {
+	t.Parallel()
+
+	b, err := frontend.NewBalancer("")
+	require.NoError(t, err)
+	require.IsType(t, &frontend.RandomBalancer{}, b)
+}
+
+func TestRandomBalancerReturnsAllBackends(t *testing.T) {
+	t.Parallel()
+
+	backends := testBackends(1, 1, 1)
+	res := (&frontend.RandomBalancer{}).Order(backends)
+	require.ElementsMatch(t, backends, res)
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	t.Parallel()
+
+	backends := testBackends(1, 1, 1)
+	b := &frontend.RoundRobinBalancer{}
+	for i := range 6 {
+		res := b.Order(backends)
+		require.Len(t, res, 3)
+		require.Same(t, backends[i%3], res[0], "unexpected backend in round %d", i)
+	}
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	t.Parallel()
+
+	backends := testBackends(5, 1, 1)
+	b := &frontend.WeightedRoundRobinBalancer{}
+	picks := make(map[*backend.Backend]int)
+	for range 70 {
+		res := b.Order(backends)
+		require.Len(t, res, 3)
+		picks[res[0]]++
+	}
+	require.Equal(t, 50, picks[backends[0]])
+	require.Equal(t, 10, picks[backends[1]])
+	require.Equal(t, 10, picks[backends[2]])
+}
+
+func TestWeightedRoundRobinBalancerInterleavesBackends(t *testing.T) {
+	t.Parallel()
+
+	backends := testBackends(2, 1)
+	b := &frontend.WeightedRoundRobinBalancer{}
+	var got []*backend.Backend
+	for range 3 {
+		got = append(got, b.Order(backends)[0])
+	}
+	require.Equal(t, []*backend.Backend{backends[0], backends[1], backends[0]}, got)
+}
+
+func TestWeightedRoundRobinBalancerKeepsWeightsForSubsets(t *testing.T) {
+	t.Parallel()
+
+	// subsets are passed e.g. for SNI routes and when backends are unhealthy.
+	backends := testBackends(3, 1, 1)
+	subsets := [][]*backend.Backend{
+		{backends[0], backends[1]},
+		{backends[0], backends[2]},
+	}
+	b := &frontend.WeightedRoundRobinBalancer{}
+	picks := make(map[*backend.Backend]int)
+	for i := range 400 {
+		picks[b.Order(subsets[i%2])[0]]++
+	}
+	require.Equal(t, 300, picks[backends[0]])
+	require.Equal(t, 50, picks[backends[1]])
+	require.Equal(t, 50, picks[backends[2]])
+}
+
+func TestLeastConnectionsBalancerReturnsAllBackends(t *testing.T) {
+	t.Parallel()
+
+	backends := testBackends(1, 1, 1)
+	res := (&frontend.LeastConnectionsBalancer{}).Order(backends)
+	require.ElementsMatch(t, backends, res)
+}
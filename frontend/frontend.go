@@ -3,15 +3,23 @@ package frontend
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"net/netip"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 
+	"github.com/makkes/l4proxy/accesslog"
 	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/config"
+	"github.com/makkes/l4proxy/metrics"
+	"github.com/makkes/l4proxy/proxyproto"
 )
 
 // Frontend represents a frontend listening on a host and port and serving one or more backends.
@@ -20,40 +28,276 @@ type Frontend struct {
 	BindHost    string
 	BindPort    string
 	Log         logr.Logger
-	Backends    []*backend.Backend
-	timeout     time.Duration
-	listener    net.Listener
+	// Backends holds the backends served by this frontend. Once the frontend has been started it must only be changed
+	// through [Frontend.AddBackend] and [Frontend.RemoveBackend].
+	Backends     []*backend.Backend
+	idleTimeouts backend.IdleTimeouts
+	maxLifetime  time.Duration
+	drainTimeout time.Duration
+	balancer     Balancer
+	retries      int
+	sniRouting   bool
+	tlsConfig    *tls.Config
+	limits       Limits
+	limiter      *limiter
+	// acceptProxyProtocol makes the frontend expect a PROXY protocol header on each connection, sent from one of
+	// trustedProxies (or from anywhere if it's empty).
+	acceptProxyProtocol bool
+	trustedProxies      []netip.Prefix
+	allowedSources      []netip.Prefix
+	deniedSources       []netip.Prefix
+	metrics             *metrics.Frontend
+	accessLog           *accesslog.Logger
+	listener            net.Listener
+	closeOnce           sync.Once
+	mux                 sync.RWMutex
+	conns               map[*connection]struct{}
+	connsMux            sync.Mutex
+	connWG              sync.WaitGroup
+}
+
+// connection represents a client connection accepted by a [Frontend]. conn and backend are guarded by the frontend's
+// connsMux for reading them from other goroutines. They are only changed by the goroutine serving the connection.
+type connection struct {
+	conn    net.Conn
+	cancel  context.CancelFunc
+	start   time.Time
+	backend *backend.Backend
+	// retries, stats and closeReason describe the connection for the access log. They are only accessed by the
+	// goroutine serving the connection.
+	retries     int
+	stats       backend.ConnStats
+	closeReason string
+}
+
+// ConnectionInfo describes a client connection handled by a [Frontend].
+type ConnectionInfo struct {
+	// Client is the address of the client, as announced in the PROXY protocol header if the frontend accepts them.
+	Client string `json:"client"`
+	// Backend is the address of the backend the connection is proxied to. It is empty until a backend has been
+	// selected.
+	Backend string    `json:"backend,omitempty"`
+	Since   time.Time `json:"since"`
 }
 
 // Option represents an Option passed to [NewFrontend].
 type Option func(f *Frontend)
 
-// WithTimeout sets the timeout options for a [Frontend]. See [NewFrontend].
+// WithTimeout sets the idle timeout of a [Frontend]'s connections. Connections are closed after no data has been
+// transferred in either direction for the timeout. Defaults to 30 seconds.
 func WithTimeout(t time.Duration) Option {
 	return func(f *Frontend) {
-		f.timeout = t
+		f.idleTimeouts.Idle = t
+	}
+}
+
+// WithClientIdleTimeout makes a [Frontend] close connections on which the client hasn't sent any data for the given
+// time, even if the backend is still sending data. Disabled if zero.
+func WithClientIdleTimeout(t time.Duration) Option {
+	return func(f *Frontend) {
+		f.idleTimeouts.Client = t
+	}
+}
+
+// WithBackendIdleTimeout makes a [Frontend] close connections on which the backend hasn't sent any data for the given
+// time, even if the client is still sending data. Disabled if zero.
+func WithBackendIdleTimeout(t time.Duration) Option {
+	return func(f *Frontend) {
+		f.idleTimeouts.Backend = t
+	}
+}
+
+// WithMaxConnectionLifetime makes a [Frontend] close connections after the given time since they have been accepted,
+// regardless of their activity. This makes clients reconnect eventually so that long-lived connections are spread
+// across the backends after they changed. Disabled if zero.
+func WithMaxConnectionLifetime(t time.Duration) Option {
+	return func(f *Frontend) {
+		f.maxLifetime = t
+	}
+}
+
+// WithDrainTimeout sets the time [Frontend.Stop] waits for in-flight connections to finish before closing them
+// forcibly. Defaults to 30 seconds. UDP sessions are not drained but end as soon as the frontend is closed, see
+// [Frontend.Close].
+func WithDrainTimeout(t time.Duration) Option {
+	return func(f *Frontend) {
+		f.drainTimeout = t
+	}
+}
+
+// WithAcceptProxyProtocol makes the frontend expect a version 1 or version 2 PROXY protocol header at the start of each
+// connection. The addresses announced in the header replace the connection's addresses for all further processing,
+// e.g. for logging and for sending PROXY protocol headers to backends. Connections with a missing or malformed header
+// are rejected. Only supported for TCP.
+func WithAcceptProxyProtocol(accept bool) Option {
+	return func(f *Frontend) {
+		f.acceptProxyProtocol = accept
+	}
+}
+
+// WithTrustedProxies restricts the sources allowed to send PROXY protocol headers to the given networks. Connections
+// from other sources are rejected. If no networks are given, all sources are trusted. See [WithAcceptProxyProtocol].
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(f *Frontend) {
+		f.trustedProxies = prefixes
+	}
+}
+
+// WithAllowedSources restricts the source addresses connections are accepted from to the given networks. If no
+// networks are given, connections from all sources are allowed unless denied by [WithDeniedSources]. The source is the
+// client address announced in the PROXY protocol header if the frontend accepts them, see [WithAcceptProxyProtocol],
+// and the address of the accepted connection otherwise.
+func WithAllowedSources(prefixes []netip.Prefix) Option {
+	return func(f *Frontend) {
+		f.allowedSources = prefixes
+	}
+}
+
+// WithDeniedSources rejects connections from the given networks. Denied networks take precedence over allowed ones,
+// see [WithAllowedSources].
+func WithDeniedSources(prefixes []netip.Prefix) Option {
+	return func(f *Frontend) {
+		f.deniedSources = prefixes
 	}
 }
 
+// WithLimits restricts the connections handled by the frontend. See [Limits].
+func WithLimits(l Limits) Option {
+	return func(f *Frontend) {
+		f.limits = l
+	}
+}
+
+// WithSNIRouting makes the frontend route TLS connections by the server name the client sends in the ClientHello (SNI)
+// without terminating TLS. Each connection is proxied to the backends with the most specific server name matching
+// the requested one or, if none matches, to the backends without server names. Connections that don't start with a
+// TLS ClientHello or that don't match any backend are rejected. Only supported for TCP. See
+// [backend.WithServerNames].
+func WithSNIRouting(enabled bool) Option {
+	return func(f *Frontend) {
+		f.sniRouting = enabled
+	}
+}
+
+// WithTLS makes the frontend terminate TLS using the given configuration. Connections are proxied to the backends in
+// plaintext unless the backends use TLS themselves, see [backend.WithTLS]. Only supported for TCP. A nil configuration
+// disables TLS termination.
+func WithTLS(cfg *tls.Config) Option {
+	return func(f *Frontend) {
+		f.tlsConfig = cfg
+	}
+}
+
+// WithMetrics makes the frontend and its backends record their metrics in m. The frontend's series are labeled with
+// its name, see [Frontend.Name].
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(f *Frontend) {
+		f.metrics = m.Frontend(f.Name())
+	}
+}
+
+// WithAccessLog makes the frontend write an entry to l for every client connection when it has been closed, including
+// rejected connections.
+func WithAccessLog(l *accesslog.Logger) Option {
+	return func(f *Frontend) {
+		f.accessLog = l
+	}
+}
+
+// WithRetries sets the number of other backends tried when connecting to the backend selected for a connection fails.
+// Defaults to [DefaultRetries].
+func WithRetries(n int) Option {
+	return func(f *Frontend) {
+		f.retries = n
+	}
+}
+
+// WithBalancer sets the strategy used for selecting a backend for new connections. See [NewBalancer].
+func WithBalancer(b Balancer) Option {
+	return func(f *Frontend) {
+		f.balancer = b
+	}
+}
+
+// Protocols supported by a [Frontend].
+const (
+	ProtocolTCP = config.ProtocolTCP
+	ProtocolUDP = config.ProtocolUDP
+)
+
+// Address families supported by a [Frontend]. See [Network].
+const (
+	FamilyIPv4 = config.FamilyIPv4
+	FamilyIPv6 = config.FamilyIPv6
+	FamilyDual = config.FamilyDual
+)
+
+// DefaultRetries is the default number of retries, see [WithRetries].
+const DefaultRetries = 2
+
+// CloseReasonDialError is the close reason logged to the access log for connections that couldn't be proxied because
+// connecting to all backends tried failed. The close reasons of proxied connections are the [backend.CloseReason]s and
+// rejected connections are logged with the reasons of the rejected connections metric, e.g. [metrics.ReasonDenied].
+const CloseReasonDialError = "dial_error"
+
 const (
-	interfacePrefix         = "@"
-	defaultKeepaliveTimeout = 30 * time.Second
+	interfacePrefix     = "@"
+	defaultIdleTimeout  = 30 * time.Second
+	defaultDrainTimeout = 30 * time.Second
+	// proxyHeaderTimeout is the time clients have for sending a PROXY protocol header.
+	proxyHeaderTimeout = 5 * time.Second
 )
 
+// Network returns the network name as understood by the [net] package for the given protocol and address family.
+// An empty protocol defaults to [ProtocolTCP] and an empty family defaults to [FamilyIPv4]. See [config.Network].
+func Network(protocol, family string) (string, error) {
+	return config.Network(protocol, family) //nolint:wrapcheck // the error describes the unsupported value.
+}
+
 // NewFrontend creates a new frontend with the given configuration. Use [Frontend.Start] for starting the listener.
-func NewFrontend(network, bind string, log logr.Logger, opts ...Option) (Frontend, error) {
-	var f Frontend
-	hostPort, err := parseHostPort(bind)
+// The network must be a TCP or UDP network name as understood by the [net] package, e.g. "tcp4", "tcp6" or "tcp" for
+// a dual-stack listener. See [Network]. UDP frontends track a session per client address; the session ends after the
+// frontend's idle timeout has passed without any datagrams being exchanged.
+//
+// The bind spec has the form [host:]port where host is a hostname, an IPv4 address, a bracketed IPv6 address like
+// [2001:db8::1] or the name of a network interface prefixed with "@". For interfaces, the first address of the
+// interface matching the network's address family is used.
+func NewFrontend(network, bind string, log logr.Logger, opts ...Option) (*Frontend, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	hostPort, err := parseHostPort(bind, network)
 	if err != nil {
-		return f, fmt.Errorf("error parsing frontend bind spec: %w", err)
+		return nil, fmt.Errorf("error parsing frontend bind spec: %w", err)
+	}
+	f := &Frontend{
+		BindNetwork: network,
+		BindHost:    hostPort.Host,
+		BindPort:    hostPort.Port,
+		Log:         log.WithValues("network", network, "bind", bind),
+		retries:     DefaultRetries,
+		limiter:     newLimiter(),
+		conns:       make(map[*connection]struct{}),
 	}
-	f.BindNetwork = network
-	f.BindHost = hostPort.Host
-	f.BindPort = hostPort.Port
-	f.Log = log.WithValues("network", network, "bind", bind)
 
 	for _, opt := range opts {
-		opt(&f)
+		opt(f)
+	}
+
+	if f.acceptProxyProtocol && f.Protocol() != ProtocolTCP {
+		return nil, errors.New("the PROXY protocol is only supported for TCP")
+	}
+	if f.sniRouting && f.Protocol() != ProtocolTCP {
+		return nil, errors.New("SNI routing is only supported for TCP")
+	}
+	if f.tlsConfig != nil && f.Protocol() != ProtocolTCP {
+		return nil, errors.New("TLS termination is only supported for TCP")
+	}
+
+	if f.balancer == nil {
+		f.balancer = &RandomBalancer{}
 	}
 
 	return f, nil
@@ -65,38 +309,39 @@ type HostPort struct {
 	Port string
 }
 
-func parseHostPort(hp string) (HostPort, error) {
-	parts := strings.SplitN(hp, ":", 2)
-	if len(parts) == 0 {
-		return HostPort{}, fmt.Errorf("wrong format of bind spec '%s'. Expected [host:]port", hp)
-	}
-	var host, port string
-	switch len(parts) {
-	case 1:
-		host = ""
-		port = parts[0]
-	case 2:
-		if parts[1] == "" {
+// String returns the host and port joined by a colon, wrapping IPv6 addresses in brackets.
+func (hp HostPort) String() string {
+	return net.JoinHostPort(hp.Host, hp.Port)
+}
+
+func parseHostPort(hp, network string) (HostPort, error) {
+	if !strings.Contains(hp, ":") {
+		if hp == "" {
 			return HostPort{}, fmt.Errorf("bind spec '%s' is missing a port", hp)
 		}
-		if strings.HasPrefix(parts[0], interfacePrefix) {
-			var err error
-			host, err = hostFromInterface(strings.TrimPrefix(parts[0], interfacePrefix))
-			if err != nil {
-				return HostPort{}, fmt.Errorf("failed getting IP address from interface: %w", err)
-			}
-		} else {
-			host = parts[0]
+		return HostPort{Port: hp}, nil
+	}
+	host, port, err := net.SplitHostPort(hp)
+	if err != nil {
+		return HostPort{}, fmt.Errorf("wrong format of bind spec '%s'. Expected [host:]port: %w", hp, err)
+	}
+	if port == "" {
+		return HostPort{}, fmt.Errorf("bind spec '%s' is missing a port", hp)
+	}
+	if strings.HasPrefix(host, interfacePrefix) {
+		host, err = hostFromInterface(strings.TrimPrefix(host, interfacePrefix), network)
+		if err != nil {
+			return HostPort{}, fmt.Errorf("failed getting IP address from interface: %w", err)
 		}
-		port = parts[1]
-	default:
-		return HostPort{}, fmt.Errorf("unexpected number of parts in %q. This is a bug that must be fixed", hp)
 	}
 
 	return HostPort{Host: host, Port: port}, nil
 }
 
-func hostFromInterface(ifName string) (string, error) {
+// hostFromInterface returns the first IP address of the given interface that matches the address family of the
+// network. Dual-stack networks prefer IPv4 addresses. Link-local IPv6 addresses are only used when the interface
+// doesn't have any other IPv6 address and are returned with the interface name as zone.
+func hostFromInterface(ifName, network string) (string, error) {
 	inf, err := net.InterfaceByName(ifName)
 	if err != nil {
 		return "", fmt.Errorf("failed getting interface by name %q: %w", ifName, err)
@@ -109,130 +354,700 @@ func hostFromInterface(ifName string) (string, error) {
 		return "", fmt.Errorf("interface %q has no address", inf.Name)
 	}
 
-	ipNet, ok := addrs[0].(*net.IPNet)
-	if !ok {
-		return "", fmt.Errorf("address %q is not an IP network address", addrs[0].String())
+	var ipv4, ipv6, linkLocal net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		switch {
+		case ipNet.IP.To4() != nil:
+			if ipv4 == nil {
+				ipv4 = ipNet.IP
+			}
+		case ipNet.IP.IsLinkLocalUnicast():
+			if linkLocal == nil {
+				linkLocal = ipNet.IP
+			}
+		default:
+			if ipv6 == nil {
+				ipv6 = ipNet.IP
+			}
+		}
 	}
-	return ipNet.IP.String(), nil
+
+	switch {
+	case ipv4 != nil && !strings.HasSuffix(network, "6"):
+		return ipv4.String(), nil
+	case strings.HasSuffix(network, "4"):
+	case ipv6 != nil:
+		return ipv6.String(), nil
+	case linkLocal != nil:
+		return linkLocal.String() + "%" + inf.Name, nil
+	}
+	return "", fmt.Errorf("interface %q has no address suitable for network %s", inf.Name, network)
 }
 
-// AddBackend creates a new [backend.Backend] and adds it to the list of backends served by this frontend.
-func (f *Frontend) AddBackend(hostPort string, healthInterval int) error {
-	backendAddr, err := parseHostPort(hostPort)
+// Name returns the frontend's network and bind address, e.g. "tcp4/127.0.0.1:8080". It identifies the frontend in
+// metrics.
+func (f *Frontend) Name() string {
+	return f.BindNetwork + "/" + HostPort{Host: f.BindHost, Port: f.BindPort}.String()
+}
+
+// Protocol returns the frontend's protocol, i.e. its network without the address family suffix.
+func (f *Frontend) Protocol() string {
+	return strings.TrimRight(f.BindNetwork, "46")
+}
+
+// backendNetwork returns the network used for dialing the backend at the given host. Backends given as IP address
+// use the address family of that address; all others use the frontend's network.
+func (f *Frontend) backendNetwork(host string) string {
+	ip, err := netip.ParseAddr(host)
 	if err != nil {
-		return fmt.Errorf("backend spec '%s' has errors: %w", hostPort, err)
+		return f.BindNetwork
 	}
+	if ip.Unmap().Is4() {
+		return f.Protocol() + "4"
+	}
+	return f.Protocol() + "6"
+}
 
-	be := backend.NewBackend("tcp4", fmt.Sprintf("%s:%s", backendAddr.Host, backendAddr.Port), f.Log)
+// Update applies the given options to the frontend. It may be called while the frontend is running; changes only
+// affect connections accepted afterwards.
+func (f *Frontend) Update(opts ...Option) {
+	f.mux.Lock()
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.mux.Unlock()
+}
+
+// AddBackend creates a new [backend.Backend] and adds it to the list of backends served by this frontend. The given
+// options are passed on to [backend.NewBackend].
+func (f *Frontend) AddBackend(hostPort string, healthInterval int, opts ...backend.Option) error {
+	be, err := f.newBackend(hostPort, opts...)
+	if err != nil {
+		return err
+	}
 	if err := be.Start(healthInterval); err != nil {
 		return fmt.Errorf("failed to start backend: %w", err)
 	}
+	f.mux.Lock()
 	f.Backends = append(f.Backends, be)
+	f.mux.Unlock()
+
+	return nil
+}
+
+// ReplaceBackend replaces the backend with the given address by a new one created from the given options, e.g. because
+// its configuration changed. The new backend takes over the health, the administrative state and the metrics of the
+// old one, see [backend.WithPreviousState], so that connections keep being proxied to it and its counters keep going
+// up. The old backend is stopped like by [Frontend.RemoveBackend], except for its metrics being kept. If there is no
+// backend with the given address, the new one is added.
+func (f *Frontend) ReplaceBackend(hostPort string, healthInterval int, opts ...backend.Option) error {
+	backendAddr, err := parseHostPort(hostPort, f.BindNetwork)
+	if err != nil {
+		return fmt.Errorf("backend spec '%s' has errors: %w", hostPort, err)
+	}
+	f.mux.RLock()
+	idx := slices.IndexFunc(f.Backends, func(be *backend.Backend) bool { return be.Addr == backendAddr.String() })
+	var old *backend.Backend
+	if idx >= 0 {
+		old = f.Backends[idx]
+	}
+	f.mux.RUnlock()
+	if old == nil {
+		return f.AddBackend(hostPort, healthInterval, opts...)
+	}
+
+	be, err := f.newBackend(hostPort, append(opts, backend.WithPreviousState(old))...)
+	if err != nil {
+		return err
+	}
+	f.mux.Lock()
+	// the slice is cloned because connection handlers might still be iterating over the old one.
+	backends := slices.Clone(f.Backends)
+	if idx := slices.Index(backends, old); idx >= 0 {
+		backends[idx] = be
+	} else {
+		backends = append(backends, be)
+	}
+	f.Backends = backends
+	f.mux.Unlock()
+	f.forgetBackends(old)
+
+	// the new backend has taken over the old one's metrics.
+	old.StopReplaced()
+	if err := be.Start(healthInterval); err != nil {
+		f.mux.Lock()
+		f.Backends = slices.DeleteFunc(slices.Clone(f.Backends), func(b *backend.Backend) bool { return b == be })
+		f.mux.Unlock()
+		f.forgetBackends(be)
+		be.Stop()
+		return fmt.Errorf("failed to start backend: %w", err)
+	}
 
 	return nil
 }
 
+// newBackend creates a backend with the given address that records its metrics as part of the frontend's.
+func (f *Frontend) newBackend(hostPort string, opts ...backend.Option) (*backend.Backend, error) {
+	backendAddr, err := parseHostPort(hostPort, f.BindNetwork)
+	if err != nil {
+		return nil, fmt.Errorf("backend spec '%s' has errors: %w", hostPort, err)
+	}
+
+	f.mux.RLock()
+	m := f.metrics.Backend(backendAddr.String())
+	f.mux.RUnlock()
+	opts = append([]backend.Option{backend.WithMetrics(m)}, opts...)
+
+	be := backend.NewBackend(f.backendNetwork(backendAddr.Host), backendAddr.String(), f.Log, opts...)
+	if be.ProxyProtocol != proxyproto.None && f.Protocol() != ProtocolTCP {
+		return nil, fmt.Errorf("backend %s: the PROXY protocol is only supported for TCP", hostPort)
+	}
+	return be, nil
+}
+
+// forgetBackends drops the state the balancer keeps for the given backends after they have been removed.
+func (f *Frontend) forgetBackends(backends ...*backend.Backend) {
+	f.mux.RLock()
+	balancer := f.balancer
+	f.mux.RUnlock()
+	if bf, ok := balancer.(backendForgetter); ok {
+		for _, be := range backends {
+			bf.forget(be)
+		}
+	}
+}
+
+// ListBackends returns a snapshot of the backends served by this frontend.
+func (f *Frontend) ListBackends() []*backend.Backend {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return slices.Clone(f.Backends)
+}
+
+// RemoveBackend stops the backend with the given address and removes it from the list of backends served by this
+// frontend so that it doesn't receive any new connections. Connections already proxied to the backend are not
+// interrupted. It reports whether a backend with the given address has been found.
+func (f *Frontend) RemoveBackend(hostPort string) (bool, error) {
+	backendAddr, err := parseHostPort(hostPort, f.BindNetwork)
+	if err != nil {
+		return false, fmt.Errorf("backend spec '%s' has errors: %w", hostPort, err)
+	}
+
+	var removed []*backend.Backend
+	f.mux.Lock()
+	// the slice is cloned because connection handlers might still be iterating over the old one.
+	f.Backends = slices.DeleteFunc(slices.Clone(f.Backends), func(be *backend.Backend) bool {
+		if be.Addr == backendAddr.String() {
+			removed = append(removed, be)
+			return true
+		}
+		return false
+	})
+	f.mux.Unlock()
+
+	f.forgetBackends(removed...)
+	for _, be := range removed {
+		be.Stop()
+	}
+
+	return len(removed) > 0, nil
+}
+
 // Start starts the frontend so that connections to it are proxied to/from the configured backends.
 // The frontend is shut down by a call to [Frontend.Stop] or by the frontend failing to accept connections
 // on the given address.
-//
-//nolint:gocognit // TODO: refactor this
-//revive:disable:cyclomatic // TODO: refactor this
 func (f *Frontend) Start() error {
-	listenAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%s", f.BindHost, f.BindPort))
-	if err != nil {
-		return fmt.Errorf("cannot parse listening address %s:%s: %w", f.BindHost, f.BindPort, err)
+	var err error
+	switch f.Protocol() {
+	case ProtocolTCP:
+		f.listener, err = f.listenTCP()
+	case ProtocolUDP:
+		f.listener, err = f.listenUDP()
+	default:
+		err = fmt.Errorf("unsupported network %q", f.BindNetwork)
 	}
-	f.listener, err = net.ListenTCP("tcp4", listenAddr)
 	if err != nil {
-		return fmt.Errorf("cannot start listener at %s: %w", listenAddr, err)
+		return err
 	}
 	f.Log.V(4).Info("listener started")
 
-	keepaliveTimeout := f.timeout
-	if keepaliveTimeout == 0 {
-		keepaliveTimeout = defaultKeepaliveTimeout
-	}
-
+	f.connWG.Add(1)
 	go func() {
+		defer f.connWG.Done()
 		for {
 			conn, err := f.listener.Accept()
 			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
+				if isClosedErr(err) {
 					return // assume this is a legit action caused by calling "Close" on the Frontend.
 				}
 				f.Log.Error(err, "Error accepting connection", "err", fmt.Sprintf("%#v", err))
 				return
 			}
-
-			ctx, cancel := context.WithCancel(context.Background())
-			quitCh := make(chan struct{})
-			keepaliveChan := make(chan struct{})
-
-			go func(quitCh chan struct{}) {
-				handleConn(ctx, f.Log, conn, keepaliveChan, f.Backends)
-				close(quitCh)
-			}(quitCh)
-
-			go func() {
-				timer := time.NewTimer(keepaliveTimeout)
-				for {
-					select {
-					case <-timer.C:
-						f.Log.V(5).Info("connection timed out, closing", "conn", conn.RemoteAddr())
-						cancel()
-						return
-					case <-keepaliveChan:
-						f.Log.V(5).Info("keeping connection alive", "conn", conn.RemoteAddr())
-						if !timer.Stop() {
-							<-timer.C
-						}
-						timer.Reset(keepaliveTimeout)
-					}
+			f.mux.RLock()
+			m, limits, accessLog, acceptProxyProtocol := f.metrics, f.limits, f.accessLog, f.acceptProxyProtocol
+			f.mux.RUnlock()
+			// connections from proxies are checked once the client address has been read from their PROXY protocol
+			// header, see admitProxied.
+			releaseSource := func() {}
+			if !acceptProxyProtocol {
+				if err := f.checkSource(conn.RemoteAddr()); err != nil {
+					f.refuse(conn, m, accessLog, metrics.ReasonDenied, err)
+					continue
 				}
-			}()
+				var reason string
+				releaseSource, reason, err = f.limiter.admitSource(addrOf(conn.RemoteAddr()), limits)
+				if err != nil {
+					f.refuse(conn, m, accessLog, reason, err)
+					continue
+				}
+			}
+			f.serve(conn, acceptProxyProtocol, releaseSource)
 		}
 	}()
 
 	return nil
 }
 
-// Stop stops the frontend's listener as well as all backends. See [backend.Backend.Stop].
-func (f *Frontend) Stop() {
-	if f.listener != nil {
+// serve proxies the given client connection in the background, reading a PROXY protocol header first if
+// acceptProxyProtocol is true. The connection is tracked until it has been closed so that [Frontend.Stop] can wait for
+// it. release is called when the connection has been closed.
+func (f *Frontend) serve(conn net.Conn, acceptProxyProtocol bool, release func()) {
+	f.mux.RLock()
+	idleTimeouts, maxLifetime := f.idleTimeouts, f.maxLifetime
+	m, limits, accessLog := f.metrics, f.limits, f.accessLog
+	f.mux.RUnlock()
+	if idleTimeouts.Idle == 0 {
+		idleTimeouts.Idle = defaultIdleTimeout
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if maxLifetime > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), maxLifetime)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	c := &connection{conn: conn, cancel: cancel, start: time.Now()}
+	f.connsMux.Lock()
+	f.conns[c] = struct{}{}
+	f.connsMux.Unlock()
+
+	closed := m.Accepted()
+	f.connWG.Go(func() {
+		defer closed()
+		defer release()
+		if releaseSlot, err := f.limiter.acquire(ctx, limits); err != nil {
+			f.rejectConn(c, m, metrics.ReasonConnectionLimit, err)
+		} else {
+			if releaseSource, ok := f.admitProxied(c, acceptProxyProtocol, limits, m); ok {
+				f.handleConn(ctx, c, idleTimeouts, m)
+				releaseSource()
+			}
+			releaseSlot()
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			f.Log.V(4).Info("connection reached its maximum lifetime", "client", conn.RemoteAddr().String())
+		}
+		cancel()
+		f.connsMux.Lock()
+		delete(f.conns, c)
+		f.connsMux.Unlock()
+		f.logAccess(accessLog, c)
+	})
+}
+
+// admitProxied reads the PROXY protocol header from the client connection if acceptProxyProtocol is true and checks
+// the client address announced in it against the allowed and denied sources and the per-source limits, so that clients
+// behind the same proxy don't share their limits. It returns a function that must be called when the connection has
+// been closed or false if the connection has been rejected.
+func (f *Frontend) admitProxied(c *connection, acceptProxyProtocol bool, limits Limits, m *metrics.Frontend) (func(), bool) {
+	if !acceptProxyProtocol {
+		return func() {}, true
+	}
+	conn, err := f.readProxyHeader(c.conn)
+	if err != nil {
+		f.rejectConn(c, m, metrics.ReasonProxyProtocol, err)
+		return nil, false
+	}
+	f.setConn(c, conn)
+	if err := f.checkSource(conn.RemoteAddr()); err != nil {
+		f.rejectConn(c, m, metrics.ReasonDenied, err)
+		return nil, false
+	}
+	release, reason, err := f.limiter.admitSource(addrOf(conn.RemoteAddr()), limits)
+	if err != nil {
+		f.rejectConn(c, m, reason, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// readProxyHeader reads the PROXY protocol header from conn. The returned connection reports the addresses announced
+// in the header; headers without addresses, like the ones sent by health checks, leave the connection's addresses as
+// they are. In case of an error the original connection is returned.
+func (f *Frontend) readProxyHeader(conn net.Conn) (net.Conn, error) {
+	f.mux.RLock()
+	trusted := f.trustedProxies
+	f.mux.RUnlock()
+
+	if len(trusted) > 0 {
+		src := addrOf(conn.RemoteAddr())
+		if !slices.ContainsFunc(trusted, func(p netip.Prefix) bool { return p.Contains(src) }) {
+			return conn, errors.New("source is not a trusted proxy")
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return conn, fmt.Errorf("failed setting read deadline: %w", err)
+	}
+	hdr, err := proxyproto.ReadHeader(conn)
+	if err != nil {
+		return conn, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return conn, fmt.Errorf("failed resetting read deadline: %w", err)
+	}
+
+	wrapped := proxyproto.NewConn(conn, hdr)
+	f.Log.V(4).Info("received PROXY protocol header", "proxy", conn.RemoteAddr().String(), "client", wrapped.RemoteAddr().String())
+	return wrapped, nil
+}
+
+// checkSource returns an error if connections from the given address are not allowed.
+func (f *Frontend) checkSource(addr net.Addr) error {
+	f.mux.RLock()
+	allowed, denied := f.allowedSources, f.deniedSources
+	f.mux.RUnlock()
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil
+	}
+
+	src := addrOf(addr)
+	contains := func(p netip.Prefix) bool { return p.Contains(src) }
+	if slices.ContainsFunc(denied, contains) {
+		return errors.New("source address is denied")
+	}
+	if len(allowed) > 0 && !slices.ContainsFunc(allowed, contains) {
+		return errors.New("source address is not allowed")
+	}
+	return nil
+}
+
+// addrOf returns the IP address of a TCP or UDP address. IPv4-mapped IPv6 addresses are unmapped.
+func addrOf(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	default:
+		return netip.Addr{}
+	}
+}
+
+func (f *Frontend) listenTCP() (net.Listener, error) {
+	bindAddr := HostPort{Host: f.BindHost, Port: f.BindPort}.String()
+	listenAddr, err := net.ResolveTCPAddr(f.BindNetwork, bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse listening address %s: %w", bindAddr, err)
+	}
+	l, err := net.ListenTCP(f.BindNetwork, listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start listener at %s: %w", listenAddr, err)
+	}
+	return l, nil
+}
+
+func (f *Frontend) listenUDP() (net.Listener, error) {
+	bindAddr := HostPort{Host: f.BindHost, Port: f.BindPort}.String()
+	listenAddr, err := net.ResolveUDPAddr(f.BindNetwork, bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse listening address %s: %w", bindAddr, err)
+	}
+	conn, err := net.ListenUDP(f.BindNetwork, listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start listener at %s: %w", listenAddr, err)
+	}
+	return newUDPListener(conn, f.Log), nil
+}
+
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+// Addr returns the address the frontend is listening on or nil if it hasn't been started.
+func (f *Frontend) Addr() net.Addr {
+	if f.listener == nil {
+		return nil
+	}
+	return f.listener.Addr()
+}
+
+// Connections returns information about the client connections currently handled by the frontend, oldest first.
+func (f *Frontend) Connections() []ConnectionInfo {
+	f.connsMux.Lock()
+	conns := make([]ConnectionInfo, 0, len(f.conns))
+	for c := range f.conns {
+		info := ConnectionInfo{Client: c.conn.RemoteAddr().String(), Since: c.start}
+		if c.backend != nil {
+			info.Backend = c.backend.Addr
+		}
+		conns = append(conns, info)
+	}
+	f.connsMux.Unlock()
+
+	slices.SortFunc(conns, func(a, b ConnectionInfo) int {
+		return a.Since.Compare(b.Since)
+	})
+	return conns
+}
+
+// Close closes the frontend's listener so that no new connections are accepted. Connections that are already being
+// proxied are not affected, but the frontend's metrics are removed right away so that a new frontend on the same
+// address starts with fresh series. UDP sessions end right away, too, since they share the frontend's socket. Use
+// [Frontend.Stop] for shutting down the frontend completely.
+func (f *Frontend) Close() {
+	f.closeOnce.Do(func() {
+		f.mux.RLock()
+		f.metrics.Delete()
+		f.mux.RUnlock()
+		if f.listener == nil {
+			return
+		}
 		if err := f.listener.Close(); err != nil {
 			f.Log.Error(err, "failed closing listener connection")
 		}
-		for _, be := range f.Backends {
-			be.Stop()
+	})
+}
+
+// Stop gracefully shuts down the frontend. It closes the listener (see [Frontend.Close]) and waits for in-flight
+// connections to finish. Connections still open after the drain timeout (see [WithDrainTimeout]) are closed forcibly.
+// Stop returns when all connections have been closed, after stopping all backends. See [backend.Backend.Stop].
+func (f *Frontend) Stop() {
+	f.mux.RLock()
+	drainTimeout := f.drainTimeout
+	f.mux.RUnlock()
+	if drainTimeout == 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	f.Shutdown(ctx)
+}
+
+// Shutdown is like [Frontend.Stop] but waits for in-flight connections to finish until ctx is done instead of using
+// the drain timeout, e.g. to drain all frontends within a common grace period when the process is terminated.
+func (f *Frontend) Shutdown(ctx context.Context) {
+	f.Close()
+
+	done := make(chan struct{})
+	go func() {
+		f.connWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		f.connsMux.Lock()
+		f.Log.Info("draining stopped, closing remaining connections", "connections", len(f.conns))
+		for c := range f.conns {
+			c.cancel()
 		}
+		f.connsMux.Unlock()
+		<-done
 	}
+
+	f.mux.RLock()
+	for _, be := range f.Backends {
+		be.Stop()
+	}
+	f.mux.RUnlock()
 	f.Log.V(4).Info("frontend stopped")
 }
 
-func handleConn(ctx context.Context, log logr.Logger, cconn net.Conn, keepaliveChan chan<- struct{}, backends []*backend.Backend) {
-	idcs := make([]int, len(backends))
-	for idx := range backends {
-		idcs[idx] = idx
+// availableBackends returns the backends that may receive new connections, i.e. healthy backends in the ready state
+// that haven't been ejected by outlier detection. If all of these backends have been ejected, ejections are ignored so
+// that traffic still flows.
+func (f *Frontend) availableBackends(backends []*backend.Backend) []*backend.Backend {
+	healthy := make([]*backend.Backend, 0, len(backends))
+	for _, be := range backends {
+		if !be.IsHealthy() {
+			f.Log.V(4).Info("skipping unhealthy backend", "backend", be)
+			continue
+		}
+		if state := be.State(); state != backend.StateReady {
+			f.Log.V(4).Info("skipping backend", "backend", be, "state", state)
+			continue
+		}
+		healthy = append(healthy, be)
 	}
-	rand.Shuffle(len(idcs), func(i, j int) {
-		idcs[i], idcs[j] = idcs[j], idcs[i]
-	})
-	for _, idx := range idcs {
-		if backends[idx].IsHealthy() {
-			log.V(4).Info("selecting backend", "backend", backends[idx])
-			if err := backends[idx].HandleConn(ctx, cconn, keepaliveChan); err != nil {
-				log.Error(err, "error handling connection",
-					"client", cconn.RemoteAddr().String(),
-					"backend_net", backends[idx].Network,
-					"backend_addr", backends[idx].Addr)
-			}
+
+	available := slices.DeleteFunc(slices.Clone(healthy), (*backend.Backend).IsEjected)
+	if len(available) == 0 && len(healthy) > 0 {
+		f.Log.V(2).Info("all healthy backends have been ejected, ignoring ejections")
+		return healthy
+	}
+	return available
+}
+
+// route returns the backends that may serve the client connection, terminating TLS and routing by SNI if configured.
+// The connection is rejected and false is returned if there are no such backends or TLS fails.
+func (f *Frontend) route(ctx context.Context, c *connection, m *metrics.Frontend) ([]*backend.Backend, bool) {
+	f.mux.RLock()
+	backends := f.Backends
+	sniRouting := f.sniRouting
+	tlsConfig := f.tlsConfig
+	f.mux.RUnlock()
+
+	if tlsConfig != nil {
+		tlsConn, err := terminateTLS(ctx, c.conn, tlsConfig)
+		if err != nil {
+			f.rejectConn(c, m, metrics.ReasonTLSHandshake, err)
+			return nil, false
+		}
+		f.setConn(c, tlsConn)
+	}
+	if !sniRouting {
+		return backends, true
+	}
+
+	var serverName string
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		serverName = tlsConn.ConnectionState().ServerName
+	} else {
+		name, conn, err := peekServerName(c.conn)
+		if err != nil {
+			f.rejectConn(c, m, metrics.ReasonTLSClientHello, err)
+			return nil, false
+		}
+		serverName = name
+		f.setConn(c, conn)
+	}
+
+	backends = routeByServerName(backends, serverName)
+	if len(backends) == 0 {
+		f.rejectConn(c, m, metrics.ReasonNoRoute, fmt.Errorf("no backend serves server name %q", serverName))
+		return nil, false
+	}
+	f.Log.V(4).Info("routing connection by SNI", "client", c.conn.RemoteAddr().String(), "server_name", serverName)
+	return backends, true
+}
+
+// setConn replaces the client connection of c, e.g. by a wrapper.
+func (f *Frontend) setConn(c *connection, conn net.Conn) {
+	f.connsMux.Lock()
+	c.conn = conn
+	f.connsMux.Unlock()
+}
+
+// refuse rejects a connection before serving it, see [Frontend.reject], and writes its access log entry.
+func (f *Frontend) refuse(conn net.Conn, m *metrics.Frontend, accessLog *accesslog.Logger, reason string, err error) {
+	c := &connection{conn: conn, start: time.Now()}
+	f.rejectConn(c, m, reason, err)
+	f.logAccess(accessLog, c)
+}
+
+// rejectConn rejects a connection being served, recording the reason for its access log entry.
+func (f *Frontend) rejectConn(c *connection, m *metrics.Frontend, reason string, err error) {
+	c.closeReason = reason
+	f.reject(c.conn, m, reason, err)
+}
+
+// logAccess writes the access log entry of a connection that has been closed. It must only be called by the goroutine
+// serving the connection.
+func (f *Frontend) logAccess(accessLog *accesslog.Logger, c *connection) {
+	if accessLog == nil {
+		return
+	}
+	now := time.Now()
+	entry := accesslog.Entry{
+		Time:            now,
+		Frontend:        f.Name(),
+		Client:          c.conn.RemoteAddr().String(),
+		Retries:         c.retries,
+		ConnectDuration: c.stats.ConnectDuration,
+		Duration:        now.Sub(c.start),
+		BytesToBackend:  c.stats.BytesToBackend,
+		BytesToClient:   c.stats.BytesToClient,
+		CloseReason:     c.closeReason,
+	}
+	if c.backend != nil {
+		entry.Backend = c.backend.Addr
+	}
+	if err := accessLog.Log(entry); err != nil {
+		f.Log.Error(err, "failed writing access log entry")
+	}
+}
+
+// reject closes a client connection that isn't proxied for the given reason.
+func (f *Frontend) reject(conn net.Conn, m *metrics.Frontend, reason string, err error) {
+	f.Log.V(2).Info("rejecting connection", "client", conn.RemoteAddr().String(), "reason", err.Error())
+	m.Rejected(reason)
+	if err := conn.Close(); err != nil {
+		f.Log.Error(err, "failed closing client connection")
+	}
+}
+
+func (f *Frontend) handleConn(ctx context.Context, c *connection, idleTimeouts backend.IdleTimeouts, m *metrics.Frontend) {
+	backends, ok := f.route(ctx, c, m)
+	if !ok {
+		return
+	}
+	f.mux.RLock()
+	balancer := f.balancer
+	retries := f.retries
+	f.mux.RUnlock()
+	cconn := c.conn
+
+	healthy := f.availableBackends(backends)
+	if len(healthy) == 0 {
+		f.Log.Error(nil, "no healthy backend is available")
+		c.closeReason = metrics.ReasonNoHealthyBackend
+		m.Rejected(metrics.ReasonNoHealthyBackend)
+		if err := cconn.Close(); err != nil {
+			f.Log.Error(err, "failed closing client connection")
+		}
+		return
+	}
+	if withCapacity := slices.DeleteFunc(slices.Clone(healthy), (*backend.Backend).IsFull); len(withCapacity) > 0 {
+		healthy = withCapacity
+	} else {
+		f.rejectConn(c, m, metrics.ReasonBackendLimit, errors.New("all backends have reached their connection limit"))
+		return
+	}
+
+	// nothing has been sent to the client when connecting to a backend fails so the next backend can be tried.
+	candidates := balancer.Order(healthy)
+	candidates = candidates[:min(len(candidates), max(retries, 0)+1)]
+	for idx, be := range candidates {
+		f.Log.V(4).Info("selecting backend", "backend", be)
+		f.connsMux.Lock()
+		c.backend = be
+		f.connsMux.Unlock()
+		c.retries = idx
+		stats, err := be.HandleConn(ctx, cconn, idleTimeouts)
+		if err == nil {
+			c.stats, c.closeReason = stats, string(stats.CloseReason)
 			return
 		}
-		log.V(4).Info("skipping unhealthy backend", "backend", backends[idx])
+		f.Log.Error(err, "error handling connection",
+			"client", cconn.RemoteAddr().String(),
+			"backend_net", be.Network,
+			"backend_addr", be.Addr)
+		if ctx.Err() != nil {
+			break
+		}
 	}
-	log.Error(nil, "all backends are unhealthy")
-	if err := cconn.Close(); err != nil {
-		log.Error(err, "failed closing client connection")
+
+	c.closeReason = CloseReasonDialError
+	m.Rejected(metrics.ReasonBackendUnavailable)
+	if err := cconn.Close(); err != nil && !isClosedErr(err) {
+		f.Log.Error(err, "failed closing client connection")
 	}
 }
@@ -0,0 +1,587 @@
+package frontend_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+func TestNewFrontendParsesBindSpec(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		bind string
+		host string
+		port string
+	}{
+		{bind: "80", host: "", port: "80"},
+		{bind: ":80", host: "", port: "80"},
+		{bind: "127.0.0.1:80", host: "127.0.0.1", port: "80"},
+		{bind: "example.org:80", host: "example.org", port: "80"},
+		{bind: "[2001:db8::1]:443", host: "2001:db8::1", port: "443"},
+		{bind: "[::]:443", host: "::", port: "443"},
+		{bind: "@lo:22", host: "127.0.0.1", port: "22"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bind, func(t *testing.T) {
+			t.Parallel()
+
+			fe, err := frontend.NewFrontend("tcp4", tt.bind, logr.Discard())
+			require.NoError(t, err)
+			require.Equal(t, tt.host, fe.BindHost)
+			require.Equal(t, tt.port, fe.BindPort)
+		})
+	}
+}
+
+func TestNewFrontendRejectsInvalidBindSpec(t *testing.T) {
+	t.Parallel()
+
+	for _, bind := range []string{"", "127.0.0.1:", "2001:db8::1:443", "@doesnotexist:80"} {
+		_, err := frontend.NewFrontend("tcp4", bind, logr.Discard())
+		require.Error(t, err, "bind spec %q should be rejected", bind)
+	}
+}
+
+func TestNewFrontendRejectsUnknownNetwork(t *testing.T) {
+	t.Parallel()
+
+	_, err := frontend.NewFrontend("unix", ":80", logr.Discard())
+	require.Error(t, err)
+}
+
+func TestNetwork(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		protocol string
+		family   string
+		network  string
+	}{
+		{protocol: "", family: "", network: "tcp4"},
+		{protocol: "tcp", family: "ipv6", network: "tcp6"},
+		{protocol: "tcp", family: "dual", network: "tcp"},
+		{protocol: "udp", family: "ipv4", network: "udp4"},
+		{protocol: "udp", family: "dual", network: "udp"},
+	}
+	for _, tt := range tests {
+		network, err := frontend.Network(tt.protocol, tt.family)
+		require.NoError(t, err)
+		require.Equal(t, tt.network, network)
+	}
+
+	_, err := frontend.Network("sctp", "")
+	require.Error(t, err)
+	_, err = frontend.Network("tcp", "ipv5")
+	require.Error(t, err)
+}
+
+func TestAddBackendUsesAddressFamilyOfBackend(t *testing.T) {
+	t.Parallel()
+
+	fe, err := frontend.NewFrontend("tcp", ":0", logr.Discard())
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend("[::1]:22", 1))
+	require.NoError(t, fe.AddBackend("127.0.0.1:22", 1))
+	require.NoError(t, fe.AddBackend("localhost:22", 1))
+	t.Cleanup(fe.Stop)
+
+	require.Equal(t, "tcp6", fe.Backends[0].Network)
+	require.Equal(t, "[::1]:22", fe.Backends[0].Addr)
+	require.Equal(t, "tcp4", fe.Backends[1].Network)
+	require.Equal(t, "tcp", fe.Backends[2].Network)
+}
+
+func startTCPEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	srv, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err, "could not start backend listener")
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					return
+				}
+				require.NoError(t, conn.Close())
+			}()
+		}
+	}()
+
+	return srv
+}
+
+func startTCPFrontend(t *testing.T, opts ...frontend.Option) *frontend.Frontend {
+	t.Helper()
+
+	srv := startTCPEchoServer(t)
+	fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard(), opts...)
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.Addr().String(), 1))
+	require.NoError(t, fe.Start())
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+	return fe
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, string(buf))
+}
+
+func TestStopWaitsForConnectionsToFinish(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t, frontend.WithDrainTimeout(time.Minute))
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, conn, "hello")
+
+	stopped := make(chan struct{})
+	go func() {
+		fe.Stop()
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("tcp4", fe.Addr().String())
+		if err == nil {
+			require.NoError(t, c.Close())
+		}
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond, "frontend should stop accepting connections")
+
+	// the existing connection is still being served while draining.
+	echo(t, conn, "still there")
+	select {
+	case <-stopped:
+		require.Fail(t, "Stop returned before the connection has been closed")
+	default:
+	}
+
+	require.NoError(t, conn.Close())
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "Stop didn't return after the connection has been closed")
+	}
+}
+
+func TestStopClosesConnectionsAfterDrainTimeout(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t, frontend.WithDrainTimeout(100*time.Millisecond))
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, conn, "hello")
+
+	start := time.Now()
+	fe.Stop()
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "connection should have been closed by the frontend")
+	require.NoError(t, conn.Close())
+}
+
+func TestShutdownClosesConnectionsWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t, frontend.WithDrainTimeout(time.Minute))
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, conn, "hello")
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	fe.Shutdown(ctx)
+	require.Less(t, time.Since(start), time.Minute/2, "Shutdown should not wait for the drain timeout")
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "connection should have been closed by the frontend")
+	require.NoError(t, conn.Close())
+}
+
+func TestIdleConnectionsAreClosed(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t, frontend.WithTimeout(200*time.Millisecond))
+	t.Cleanup(fe.Stop)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	// transferring data keeps the connection open for longer than the timeout.
+	for range 5 {
+		echo(t, conn, "hello")
+		time.Sleep(100 * time.Millisecond)
+	}
+	requireClosed(t, conn)
+}
+
+func TestClientIdleTimeoutClosesConnections(t *testing.T) {
+	t.Parallel()
+
+	// the backend keeps on sending data so that the connection is never idle in both directions.
+	srv, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					if _, err := conn.Write([]byte("tick")); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+		}
+	}()
+
+	fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard(), frontend.WithClientIdleTimeout(200*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.Addr().String(), 1))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = io.Copy(io.Discard, conn)
+	require.NoError(t, err, "connection should have been closed by the frontend")
+}
+
+func TestMaxConnectionLifetimeClosesBusyConnections(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t, frontend.WithMaxConnectionLifetime(300*time.Millisecond))
+	t.Cleanup(fe.Stop)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+	start := time.Now()
+	require.NoError(t, conn.SetDeadline(start.Add(3*time.Second)))
+	for {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+			require.NotErrorIs(t, err, os.ErrDeadlineExceeded, "connection should have been closed by the frontend")
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestProxiesLargeTransfers(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t)
+	t.Cleanup(fe.Stop)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	// larger than the chunks the proxy copies at once.
+	payload := make([]byte, 5<<20+17)
+	for idx := range payload {
+		payload[idx] = byte(idx % 251)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errCh <- err
+	}()
+	received := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.Equal(t, payload, received)
+}
+
+func TestHalfCloseIsPropagated(t *testing.T) {
+	t.Parallel()
+
+	// the backend only responds after the client has finished sending its request.
+	srv, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				req, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				if _, err := conn.Write(append([]byte("response to "), req...)); err != nil {
+					return
+				}
+				require.NoError(t, conn.Close())
+			}()
+		}
+	}()
+
+	fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard())
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.Addr().String(), 1))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	conn, err := net.DialTCP("tcp4", nil, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(fe.Addr().String())))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "response to request", string(resp))
+}
+
+func TestRetriesOtherBackendsWhenConnectingFails(t *testing.T) {
+	t.Parallel()
+
+	balancer, err := frontend.NewBalancer(frontend.BalanceRoundRobin)
+	require.NoError(t, err)
+	fe := startTCPFrontend(t, frontend.WithBalancer(balancer))
+	t.Cleanup(fe.Stop)
+
+	// the second backend becomes unreachable after its initial health check so that it's still considered healthy.
+	dead, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(dead.Addr().String(), 3600))
+	require.Eventually(t, fe.Backends[1].IsHealthy, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, dead.Close())
+
+	for range 4 {
+		conn, err := net.Dial("tcp4", fe.Addr().String())
+		require.NoError(t, err)
+		echo(t, conn, "hello")
+		require.NoError(t, conn.Close())
+	}
+}
+
+func TestAcceptProxyProtocolForwardsClientAddress(t *testing.T) {
+	t.Parallel()
+
+	srv, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+	lines := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			// health checks announce unknown connections.
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil && line != "PROXY UNKNOWN\r\n" {
+				lines <- line
+			}
+			require.NoError(t, conn.Close())
+		}
+	}()
+
+	fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard(),
+		frontend.WithAcceptProxyProtocol(true),
+		frontend.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}))
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.Addr().String(), 1, backend.WithProxyProtocol(proxyproto.V1)))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"))
+	require.NoError(t, err)
+
+	select {
+	case line := <-lines:
+		require.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", line)
+	case <-time.After(3 * time.Second):
+		require.Fail(t, "backend didn't receive a PROXY protocol header")
+	}
+	require.NoError(t, conn.Close())
+}
+
+func TestAcceptProxyProtocolRejectsConnections(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		trusted []netip.Prefix
+		header  string
+	}{
+		{name: "malformed header", header: "GET / HTTP/1.1\r\n\r\n"},
+		{
+			name:    "untrusted source",
+			trusted: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			header:  "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fe := startTCPFrontend(t, frontend.WithAcceptProxyProtocol(true), frontend.WithTrustedProxies(tt.trusted))
+			t.Cleanup(fe.Stop)
+
+			conn, err := net.Dial("tcp4", fe.Addr().String())
+			require.NoError(t, err)
+			_, err = conn.Write([]byte(tt.header))
+			require.NoError(t, err)
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+			_, err = conn.Read(make([]byte, 1))
+			require.Error(t, err, "connection should have been closed by the frontend")
+			require.NoError(t, conn.Close())
+		})
+	}
+}
+
+func TestAcceptProxyProtocolIsRejectedForUDP(t *testing.T) {
+	t.Parallel()
+
+	_, err := frontend.NewFrontend("udp4", ":0", logr.Discard(), frontend.WithAcceptProxyProtocol(true))
+	require.Error(t, err)
+}
+
+func TestSourceAccessLists(t *testing.T) {
+	t.Parallel()
+
+	localhost := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	other := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := map[string]struct {
+		opts    []frontend.Option
+		allowed bool
+	}{
+		"no lists":              {allowed: true},
+		"allowed source":        {opts: []frontend.Option{frontend.WithAllowedSources(localhost)}, allowed: true},
+		"source not allowed":    {opts: []frontend.Option{frontend.WithAllowedSources(other)}},
+		"denied source":         {opts: []frontend.Option{frontend.WithDeniedSources(localhost)}},
+		"source not denied":     {opts: []frontend.Option{frontend.WithDeniedSources(other)}, allowed: true},
+		"deny takes precedence": {opts: []frontend.Option{frontend.WithAllowedSources(localhost), frontend.WithDeniedSources(localhost)}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fe := startTCPFrontend(t, tt.opts...)
+			t.Cleanup(fe.Stop)
+
+			conn, err := net.Dial("tcp4", fe.Addr().String())
+			require.NoError(t, err)
+			if tt.allowed {
+				echo(t, conn, "hello")
+			} else {
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+				_, err = conn.Read(make([]byte, 1))
+				require.ErrorIs(t, err, io.EOF, "connection should have been closed by the frontend")
+			}
+			require.NoError(t, conn.Close())
+		})
+	}
+}
+
+func TestSourceAccessListsApplyToProxiedClients(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		header  string
+		allowed bool
+	}{
+		"allowed client": {header: "PROXY TCP4 198.51.100.7 198.51.100.2 56324 443\r\n", allowed: true},
+		"denied client":  {header: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// the proxy's own address is neither allowed nor denied so that only the client address decides.
+			fe := startTCPFrontend(t,
+				frontend.WithAcceptProxyProtocol(true),
+				frontend.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}),
+				frontend.WithAllowedSources([]netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}),
+				frontend.WithDeniedSources([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}))
+			t.Cleanup(fe.Stop)
+
+			conn, err := net.Dial("tcp4", fe.Addr().String())
+			require.NoError(t, err)
+			_, err = conn.Write([]byte(tt.header))
+			require.NoError(t, err)
+			if tt.allowed {
+				echo(t, conn, "hello")
+			} else {
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+				_, err = conn.Read(make([]byte, 1))
+				require.ErrorIs(t, err, io.EOF, "connection should have been closed by the frontend")
+			}
+			require.NoError(t, conn.Close())
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/makkes/l4proxy/metrics"
+)
+
+// bucketSweepInterval is the minimum time between two removals of unused token buckets.
+const bucketSweepInterval = time.Minute
+
+// Limits restricts the connections handled by a [Frontend]. Zero values disable the respective limit.
+type Limits struct {
+	// MaxConnections is the maximum number of connections handled concurrently by the frontend. Connections exceeding
+	// it wait for up to QueueTimeout for another connection to finish and are rejected afterwards.
+	MaxConnections int
+	// QueueTimeout is the time connections exceeding MaxConnections wait before being rejected. Zero rejects them
+	// immediately.
+	QueueTimeout time.Duration
+	// MaxConnectionsPerSource is the maximum number of concurrent connections from a single source IP address. The
+	// per-source limits apply to the client address announced in the PROXY protocol header if the frontend accepts
+	// them, see [WithAcceptProxyProtocol].
+	MaxConnectionsPerSource int
+	// RatePerSource is the number of new connections per second accepted from a single source IP address. Up to
+	// BurstPerSource connections are accepted at once, which defaults to RatePerSource rounded up.
+	RatePerSource  float64
+	BurstPerSource int
+}
+
+// limiter tracks the connections of a frontend for enforcing its [Limits]. Its state is kept when the limits change.
+type limiter struct {
+	mux     sync.Mutex
+	active  int
+	sources map[netip.Addr]int
+	buckets map[netip.Addr]*tokenBucket
+	// released is closed and replaced whenever a connection releases its slot so that queued connections can retry.
+	released  chan struct{}
+	lastSweep time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		sources:  make(map[netip.Addr]int),
+		buckets:  make(map[netip.Addr]*tokenBucket),
+		released: make(chan struct{}),
+	}
+}
+
+// tokenBucket implements rate limiting: tokens are added at a constant rate up to a maximum and each connection
+// consumes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and consumes a token if one is available.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// admitSource checks the per-source limits for a new connection from src. It returns a function that must be called
+// when the connection has been closed or the reason and an error if the connection must be rejected.
+func (l *limiter) admitSource(src netip.Addr, limits Limits) (func(), string, error) {
+	if limits.MaxConnectionsPerSource <= 0 && limits.RatePerSource <= 0 {
+		return func() {}, "", nil
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	if limits.RatePerSource > 0 {
+		burst := limits.BurstPerSource
+		if burst <= 0 {
+			burst = max(1, int(math.Ceil(limits.RatePerSource)))
+		}
+		l.sweepBuckets(now, limits.RatePerSource, burst)
+		bucket, ok := l.buckets[src]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(burst), last: now}
+			l.buckets[src] = bucket
+		}
+		if !bucket.take(now, limits.RatePerSource, burst) {
+			return nil, metrics.ReasonRateLimit,
+				fmt.Errorf("source exceeded the rate of %g connections per second", limits.RatePerSource)
+		}
+	}
+
+	if limits.MaxConnectionsPerSource > 0 && l.sources[src] >= limits.MaxConnectionsPerSource {
+		return nil, metrics.ReasonSourceLimit,
+			fmt.Errorf("source has reached the limit of %d connections", limits.MaxConnectionsPerSource)
+	}
+	l.sources[src]++
+
+	return func() {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		if l.sources[src]--; l.sources[src] <= 0 {
+			delete(l.sources, src)
+		}
+	}, "", nil
+}
+
+// sweepBuckets removes the buckets that have been refilled completely as they are equivalent to new buckets.
+func (l *limiter) sweepBuckets(now time.Time, rate float64, burst int) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for src, bucket := range l.buckets {
+		bucket.refill(now, rate, burst)
+		if bucket.tokens >= float64(burst) {
+			delete(l.buckets, src)
+		}
+	}
+}
+
+// acquire reserves one of the frontend's connection slots, waiting for up to the queue timeout if all slots are taken.
+// It returns a function releasing the slot.
+func (l *limiter) acquire(ctx context.Context, limits Limits) (func(), error) {
+	if limits.MaxConnections <= 0 {
+		return func() {}, nil
+	}
+
+	var timeout <-chan time.Time
+	if limits.QueueTimeout > 0 {
+		timer := time.NewTimer(limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		l.mux.Lock()
+		if l.active < limits.MaxConnections {
+			l.active++
+			l.mux.Unlock()
+			return l.release, nil
+		}
+		released := l.released
+		l.mux.Unlock()
+
+		if timeout == nil {
+			return nil, fmt.Errorf("frontend has reached the limit of %d connections", limits.MaxConnections)
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, fmt.Errorf("no connection slot became available within %s", limits.QueueTimeout)
+		case <-ctx.Done():
+			return nil, errors.New("connection has been closed while waiting for a connection slot")
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.mux.Lock()
+	l.active--
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mux.Unlock()
+}
@@ -0,0 +1,131 @@
+package frontend_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+)
+
+// requireClosed asserts that the frontend closes the given connection.
+func requireClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "connection should have been closed by the frontend")
+	require.NoError(t, conn.Close())
+}
+
+func TestLimitsRejectExcessConnections(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]frontend.Limits{
+		"frontend limit":   {MaxConnections: 2},
+		"per-source limit": {MaxConnectionsPerSource: 2},
+		"per-source rate":  {RatePerSource: 0.01, BurstPerSource: 2},
+	}
+	for name, limits := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fe := startTCPFrontend(t, frontend.WithLimits(limits))
+			t.Cleanup(fe.Stop)
+
+			for range 2 {
+				conn, err := net.Dial("tcp4", fe.Addr().String())
+				require.NoError(t, err)
+				echo(t, conn, "hello")
+				t.Cleanup(func() {
+					require.NoError(t, conn.Close())
+				})
+			}
+
+			conn, err := net.Dial("tcp4", fe.Addr().String())
+			require.NoError(t, err)
+			requireClosed(t, conn)
+		})
+	}
+}
+
+func TestPerSourceLimitsApplyToProxiedClients(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t,
+		frontend.WithAcceptProxyProtocol(true),
+		frontend.WithLimits(frontend.Limits{MaxConnectionsPerSource: 1}))
+	t.Cleanup(fe.Stop)
+
+	// both clients connect through the same upstream proxy address, 127.0.0.1.
+	dial := func(client string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp4", fe.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("PROXY TCP4 " + client + " 198.51.100.2 56324 443\r\n"))
+		require.NoError(t, err)
+		return conn
+	}
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		conn := dial(client)
+		echo(t, conn, "hello")
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+	}
+
+	requireClosed(t, dial("192.0.2.1"))
+}
+
+func TestLimitsQueueExcessConnections(t *testing.T) {
+	t.Parallel()
+
+	fe := startTCPFrontend(t, frontend.WithLimits(frontend.Limits{MaxConnections: 1, QueueTimeout: 3 * time.Second}))
+	t.Cleanup(fe.Stop)
+
+	first, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, first, "hello")
+
+	queued, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	_, err = queued.Write([]byte("queued"))
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, first.Close())
+
+	buf := make([]byte, len("queued"))
+	require.NoError(t, queued.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = io.ReadFull(queued, buf)
+	require.NoError(t, err, "queued connection should be proxied once a slot is free")
+	require.Equal(t, "queued", string(buf))
+	require.NoError(t, queued.Close())
+}
+
+func TestBackendConnectionLimit(t *testing.T) {
+	t.Parallel()
+
+	srv := startTCPEchoServer(t)
+	fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard())
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.Addr().String(), 1, backend.WithMaxConnections(1)))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	first, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, first, "hello")
+	require.True(t, fe.Backends[0].IsFull())
+
+	second, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	requireClosed(t, second)
+	require.NoError(t, first.Close())
+}
@@ -0,0 +1,166 @@
+package frontend_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/frontend"
+	"github.com/makkes/l4proxy/metrics"
+)
+
+func TestMetricsAreRecorded(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+	fe := startTCPFrontend(t, frontend.WithMetrics(m))
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	echo(t, conn, "hello")
+
+	be, name := fe.Backends[0].Addr, fe.Name()
+	expected := fmt.Sprintf(`
+# HELP l4proxy_frontend_connections_accepted_total Number of client connections accepted by the frontend.
+# TYPE l4proxy_frontend_connections_accepted_total counter
+l4proxy_frontend_connections_accepted_total{frontend=%[1]q} 1
+# HELP l4proxy_frontend_connections_active Number of client connections currently handled by the frontend.
+# TYPE l4proxy_frontend_connections_active gauge
+l4proxy_frontend_connections_active{frontend=%[1]q} 1
+# HELP l4proxy_backend_healthy Whether the backend is considered healthy (1) or not (0).
+# TYPE l4proxy_backend_healthy gauge
+l4proxy_backend_healthy{backend=%[2]q,frontend=%[1]q} 1
+# HELP l4proxy_backend_transferred_bytes_total Number of bytes proxied between clients and the backend, by direction.
+# TYPE l4proxy_backend_transferred_bytes_total counter
+l4proxy_backend_transferred_bytes_total{backend=%[2]q,direction="to_backend",frontend=%[1]q} 5
+l4proxy_backend_transferred_bytes_total{backend=%[2]q,direction="to_client",frontend=%[1]q} 5
+`, name, be)
+	// the bytes sent to the client are counted after they have been written so they might not have been recorded yet.
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NoError(c, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+			"l4proxy_frontend_connections_accepted_total",
+			"l4proxy_frontend_connections_active",
+			"l4proxy_backend_healthy",
+			"l4proxy_backend_transferred_bytes_total",
+		))
+	}, 3*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		n, err := testutil.GatherAndCount(reg, "l4proxy_frontend_connection_duration_seconds")
+		return err == nil && n == 1
+	}, 3*time.Second, 10*time.Millisecond, "connection duration should be recorded")
+
+	fe.Stop()
+	n, err := testutil.GatherAndCount(reg)
+	require.NoError(t, err)
+	require.Zero(t, n, "stopping the frontend should remove its series")
+}
+
+func TestMetricsOfNewFrontendSurviveDrainingOfOldOne(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+	srv := startTCPEchoServer(t)
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	bind := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	start := func() *frontend.Frontend {
+		fe, err := frontend.NewFrontend("tcp4", bind, logr.Discard(), frontend.WithMetrics(m))
+		require.NoError(t, err)
+		require.NoError(t, fe.AddBackend(srv.Addr().String(), 1))
+		require.NoError(t, fe.Start())
+		require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+		return fe
+	}
+
+	// the old frontend keeps draining a connection while the new one takes over its address.
+	oldFe := start()
+	oldConn, err := net.Dial("tcp4", bind)
+	require.NoError(t, err)
+	echo(t, oldConn, "hello")
+	oldFe.Close()
+
+	newFe := start()
+	t.Cleanup(newFe.Stop)
+	newConn, err := net.Dial("tcp4", bind)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, newConn.Close())
+	})
+	echo(t, newConn, "hello")
+
+	require.NoError(t, oldConn.Close())
+	oldFe.Stop()
+
+	expected := fmt.Sprintf(`
+# HELP l4proxy_frontend_connections_active Number of client connections currently handled by the frontend.
+# TYPE l4proxy_frontend_connections_active gauge
+l4proxy_frontend_connections_active{frontend=%[1]q} 1
+# HELP l4proxy_backend_connections_active Number of connections currently proxied to the backend.
+# TYPE l4proxy_backend_connections_active gauge
+l4proxy_backend_connections_active{backend=%[2]q,frontend=%[1]q} 1
+# HELP l4proxy_backend_healthy Whether the backend is considered healthy (1) or not (0).
+# TYPE l4proxy_backend_healthy gauge
+l4proxy_backend_healthy{backend=%[2]q,frontend=%[1]q} 1
+`, newFe.Name(), srv.Addr().String())
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"l4proxy_frontend_connections_active",
+		"l4proxy_backend_connections_active",
+		"l4proxy_backend_healthy",
+	))
+}
+
+func TestMetricsOfReplacedBackendsAreKept(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+	fe := startTCPFrontend(t, frontend.WithMetrics(m))
+	t.Cleanup(fe.Stop)
+	be := fe.ListBackends()[0].Addr
+
+	transfer := func() {
+		t.Helper()
+		conn, err := net.Dial("tcp4", fe.Addr().String())
+		require.NoError(t, err)
+		echo(t, conn, "hello")
+		require.NoError(t, conn.Close())
+	}
+	transfer()
+	old := fe.ListBackends()[0]
+	require.NoError(t, fe.ReplaceBackend(be, 1))
+	require.NotSame(t, old, fe.ListBackends()[0])
+	transfer()
+
+	expected := fmt.Sprintf(`
+# HELP l4proxy_backend_healthy Whether the backend is considered healthy (1) or not (0).
+# TYPE l4proxy_backend_healthy gauge
+l4proxy_backend_healthy{backend=%[2]q,frontend=%[1]q} 1
+# HELP l4proxy_backend_transferred_bytes_total Number of bytes proxied between clients and the backend, by direction.
+# TYPE l4proxy_backend_transferred_bytes_total counter
+l4proxy_backend_transferred_bytes_total{backend=%[2]q,direction="to_backend",frontend=%[1]q} 10
+l4proxy_backend_transferred_bytes_total{backend=%[2]q,direction="to_client",frontend=%[1]q} 10
+`, fe.Name(), be)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NoError(c, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+			"l4proxy_backend_healthy",
+			"l4proxy_backend_transferred_bytes_total",
+		))
+	}, 3*time.Second, 10*time.Millisecond, "the replaced backend's counters should have kept going up")
+}
@@ -0,0 +1,116 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/makkes/l4proxy/backend"
+)
+
+// clientHelloTimeout is the time clients have for sending the TLS ClientHello on frontends routing by SNI.
+const clientHelloTimeout = 5 * time.Second
+
+// errClientHelloRead aborts the TLS handshake used for reading the ClientHello once the ClientHello has been parsed.
+var errClientHelloRead = errors.New("ClientHello has been read")
+
+// peekServerName reads the TLS ClientHello from conn and returns the server name the client requested, which is empty
+// if the client didn't send the SNI extension. TLS is not terminated: the returned connection replays the data read
+// from conn so that the whole handshake can be proxied to a backend.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		return "", conn, fmt.Errorf("failed setting read deadline: %w", err)
+	}
+
+	// the ClientHello is parsed by a TLS server handshake that is aborted as soon as the ClientHello has been
+	// received. The handshake reads from a recording connection and can't write anything to the client.
+	var buf bytes.Buffer
+	var serverName string
+	var helloRead bool
+	cfg := &tls.Config{ //nolint:gosec // the handshake is always aborted after the ClientHello.
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, helloRead = hello.ServerName, true
+			return nil, errClientHelloRead
+		},
+	}
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, cfg).HandshakeContext(context.Background())
+	if !helloRead {
+		return "", conn, fmt.Errorf("failed reading TLS ClientHello: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", conn, fmt.Errorf("failed resetting read deadline: %w", err)
+	}
+
+	return serverName, &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}, nil
+}
+
+// readOnlyConn is a [net.Conn] that only supports reading. Closing it and setting deadlines have no effect on the
+// underlying connection.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b) //nolint:wrapcheck // the error is passed on unchanged on purpose.
+}
+
+func (readOnlyConn) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (readOnlyConn) Close() error {
+	return nil
+}
+
+func (readOnlyConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (readOnlyConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (readOnlyConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// peekedConn is a [net.Conn] returning data that has already been read from the underlying connection before the
+// data that hasn't been read yet.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b) //nolint:wrapcheck // the error is passed on unchanged on purpose.
+}
+
+// NetConn returns the underlying connection.
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// routeByServerName returns the backends serving the given TLS server name. These are the backends with the most
+// specific matching server name or, if none matches, the backends without server names. See
+// [backend.Backend.MatchServerName].
+func routeByServerName(backends []*backend.Backend, serverName string) []*backend.Backend {
+	best := -1
+	var res []*backend.Backend
+	for _, be := range backends {
+		switch score := be.MatchServerName(serverName); {
+		case score > best:
+			best = score
+			res = []*backend.Backend{be}
+		case score == best && score >= 0:
+			res = append(res, be)
+		}
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package frontend_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+)
+
+// startTLSServer starts an HTTPS server responding with the given name.
+func startTLSServer(t *testing.T, name string) string {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, err := io.WriteString(w, name)
+		require.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// getWithServerName sends a request to addr using the given TLS server name and returns the response body.
+func getWithServerName(t *testing.T, addr, serverName string) (string, error) {
+	t.Helper()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				ServerName:         serverName,
+				InsecureSkipVerify: true, //nolint:gosec // the test servers use self-signed certificates.
+			},
+		},
+		Timeout: 3 * time.Second,
+	}
+	resp, err := client.Get(fmt.Sprintf("https://%s/", addr))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		require.NoError(t, resp.Body.Close())
+	}()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body), nil
+}
+
+func startSNIFrontend(t *testing.T, backends map[string][]string) *frontend.Frontend {
+	t.Helper()
+
+	fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard(), frontend.WithSNIRouting(true))
+	require.NoError(t, err)
+	for name, serverNames := range backends {
+		require.NoError(t, fe.AddBackend(startTLSServer(t, name), 1, backend.WithServerNames(serverNames...)))
+	}
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	for _, be := range fe.Backends {
+		require.Eventually(t, be.IsHealthy, 3*time.Second, 10*time.Millisecond)
+	}
+	return fe
+}
+
+func TestSNIRoutingSelectsBackendByServerName(t *testing.T) {
+	t.Parallel()
+
+	fe := startSNIFrontend(t, map[string][]string{
+		"exact":    {"app.example.com"},
+		"wildcard": {"*.example.com"},
+		"default":  nil,
+	})
+
+	for serverName, expected := range map[string]string{
+		"app.example.com":   "exact",
+		"other.example.com": "wildcard",
+		"example.org":       "default",
+		"":                  "default",
+	} {
+		body, err := getWithServerName(t, fe.Addr().String(), serverName)
+		require.NoError(t, err, "server name %q", serverName)
+		require.Equal(t, expected, body, "server name %q", serverName)
+	}
+}
+
+func TestSNIRoutingRejectsConnections(t *testing.T) {
+	t.Parallel()
+
+	fe := startSNIFrontend(t, map[string][]string{
+		"exact": {"app.example.com"},
+	})
+
+	_, err := getWithServerName(t, fe.Addr().String(), "other.example.com")
+	require.Error(t, err, "connections without matching backend should be rejected")
+
+	conn, err := net.Dial("tcp4", fe.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "connections not starting with a TLS ClientHello should be rejected")
+	require.NoError(t, conn.Close())
+}
+
+func TestSNIRoutingIsRejectedForUDP(t *testing.T) {
+	t.Parallel()
+
+	_, err := frontend.NewFrontend("udp4", "127.0.0.1:0", logr.Discard(), frontend.WithSNIRouting(true))
+	require.Error(t, err)
+}
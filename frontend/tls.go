@@ -0,0 +1,123 @@
+package frontend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// tlsHandshakeTimeout is the time clients have for completing the TLS handshake on frontends terminating TLS.
+	tlsHandshakeTimeout = 10 * time.Second
+	// certificateCheckInterval is the minimum time between two checks for changed certificate files.
+	certificateCheckInterval = 3 * time.Second
+)
+
+// CertificateReloader serves a TLS certificate from a certificate and a key file. The files are reloaded when their
+// modification time or size has changed so that certificates can be renewed without restarting the frontend. Files
+// replaced by older ones, e.g. when keeping the original modification time while copying, are reloaded as well. Use
+// [CertificateReloader.GetCertificate] as [tls.Config.GetCertificate].
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	log      logr.Logger
+	mux      sync.Mutex
+	cert     *tls.Certificate
+	// stats holds the state of both files when they have been loaded.
+	stats     [2]fileStat
+	lastCheck time.Time
+}
+
+// fileStat identifies a version of a file by its modification time and size.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func (s fileStat) equal(o fileStat) bool {
+	return s.modTime.Equal(o.modTime) && s.size == o.size
+}
+
+// NewCertificateReloader creates a reloader for the given PEM-encoded certificate and key files. It returns an error if
+// the files can't be loaded.
+func NewCertificateReloader(certFile, keyFile string, log logr.Logger) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log.WithValues("cert_file", certFile, "key_file", keyFile),
+	}
+	stats, err := r.statFiles()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(stats); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files have changed. If reloading fails,
+// the previous certificate is returned.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if time.Since(r.lastCheck) < certificateCheckInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	stats, err := r.statFiles()
+	if err != nil {
+		r.log.Error(err, "failed checking certificate files for changes")
+		return r.cert, nil
+	}
+	if stats[0].equal(r.stats[0]) && stats[1].equal(r.stats[1]) {
+		return r.cert, nil
+	}
+	if err := r.load(stats); err != nil {
+		r.log.Error(err, "failed reloading certificate, keeping the previous one")
+		return r.cert, nil
+	}
+	r.log.Info("reloaded certificate")
+	return r.cert, nil
+}
+
+func (r *CertificateReloader) load(stats [2]fileStat) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed loading certificate: %w", err)
+	}
+	r.cert = &cert
+	r.stats = stats
+	return nil
+}
+
+// statFiles returns the modification time and size of the certificate and the key file.
+func (r *CertificateReloader) statFiles() ([2]fileStat, error) {
+	var stats [2]fileStat
+	for i, file := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return stats, fmt.Errorf("failed to stat %q: %w", file, err)
+		}
+		stats[i] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stats, nil
+}
+
+// terminateTLS completes a TLS server handshake on conn and returns the TLS connection.
+func terminateTLS(ctx context.Context, conn net.Conn, cfg *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Server(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
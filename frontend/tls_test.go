@@ -0,0 +1,187 @@
+package frontend_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/backend"
+	"github.com/makkes/l4proxy/frontend"
+)
+
+// writeCertificate writes a self-signed certificate for localhost and its key to the given files and returns the
+// certificate.
+func writeCertificate(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert
+}
+
+func TestCertificateReloaderReloadsChangedFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile)
+	reloader, err := frontend.NewCertificateReloader(certFile, keyFile, logr.Discard())
+	require.NoError(t, err)
+
+	second := writeCertificate(t, certFile, keyFile)
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, second.Raw, cert.Certificate[0], "changed certificate should have been reloaded")
+}
+
+func TestCertificateReloaderReloadsFilesReplacedByOlderOnes(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile)
+	reloader, err := frontend.NewCertificateReloader(certFile, keyFile, logr.Discard())
+	require.NoError(t, err)
+
+	second := writeCertificate(t, certFile, keyFile)
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(certFile, past, past))
+	require.NoError(t, os.Chtimes(keyFile, past, past))
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, second.Raw, cert.Certificate[0], "certificate with an older modification time should have been reloaded")
+}
+
+func TestNewCertificateReloaderFailsForMissingFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	_, err := frontend.NewCertificateReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), logr.Discard())
+	require.Error(t, err)
+}
+
+// startTLSEchoServer starts a TLS server echoing all data using the given certificate files.
+func startTLSEchoServer(t *testing.T, certFile, keyFile string) string {
+	t.Helper()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	srv, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					return
+				}
+				require.NoError(t, conn.Close())
+			}()
+		}
+	}()
+	return srv.Addr().String()
+}
+
+func TestTLSTermination(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert := writeCertificate(t, certFile, keyFile)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	reloader, err := frontend.NewCertificateReloader(certFile, keyFile, logr.Discard())
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		backendAddr string
+		opts        []backend.Option
+	}{
+		"plaintext backend": {
+			backendAddr: startTCPEchoServer(t).Addr().String(),
+		},
+		"re-encrypting to backend": {
+			backendAddr: startTLSEchoServer(t, certFile, keyFile),
+			opts: []backend.Option{backend.WithTLS(&tls.Config{
+				RootCAs:    roots,
+				ServerName: "localhost",
+				MinVersion: tls.VersionTLS12,
+			})},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fe, err := frontend.NewFrontend("tcp4", "127.0.0.1:0", logr.Discard(), frontend.WithTLS(&tls.Config{
+				GetCertificate: reloader.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
+			}))
+			require.NoError(t, err)
+			require.NoError(t, fe.AddBackend(tt.backendAddr, 1, tt.opts...))
+			require.NoError(t, fe.Start())
+			t.Cleanup(fe.Stop)
+			require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+			conn, err := tls.Dial("tcp4", fe.Addr().String(), &tls.Config{
+				RootCAs:    roots,
+				ServerName: "localhost",
+				MinVersion: tls.VersionTLS12,
+			})
+			require.NoError(t, err)
+			echo(t, conn, "hello")
+			require.NoError(t, conn.Close())
+
+			plain, err := net.Dial("tcp4", fe.Addr().String())
+			require.NoError(t, err)
+			_, err = plain.Write([]byte("hello\r\n"))
+			require.NoError(t, err)
+			require.NoError(t, plain.SetReadDeadline(time.Now().Add(3*time.Second)))
+			_, err = io.ReadAll(plain)
+			require.NoError(t, err, "connections failing the handshake should be closed")
+			require.NoError(t, plain.Close())
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package frontend
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// maxDatagramSize is the maximum size of a UDP payload.
+	maxDatagramSize = 65535
+	// sessionQueueLen is the number of datagrams buffered per session before further datagrams from that client
+	// are dropped.
+	sessionQueueLen = 64
+)
+
+// udpListener implements [net.Listener] on top of a UDP socket. Every client address sending datagrams to the
+// socket is represented by a session that is returned from Accept as a [net.Conn], so that UDP traffic can be handled
+// just like TCP connections. Datagrams written to a session are sent back to the client address the session belongs
+// to.
+type udpListener struct {
+	conn     *net.UDPConn
+	log      logr.Logger
+	acceptCh chan *udpSession
+	closeCh  chan struct{}
+	once     sync.Once
+	mux      sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func newUDPListener(conn *net.UDPConn, log logr.Logger) *udpListener {
+	l := &udpListener{
+		conn:     conn,
+		log:      log,
+		acceptCh: make(chan *udpSession),
+		closeCh:  make(chan struct{}),
+		sessions: make(map[string]*udpSession),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !isClosedErr(err) {
+				l.log.Error(err, "failed reading from UDP socket")
+			}
+			l.shutdown()
+			return
+		}
+
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+
+		l.mux.Lock()
+		sess, ok := l.sessions[addr.String()]
+		if !ok {
+			sess = &udpSession{
+				l:            l,
+				raddr:        addr,
+				packets:      make(chan []byte, sessionQueueLen),
+				closeCh:      make(chan struct{}),
+				readDeadline: newDeadline(),
+			}
+			l.sessions[addr.String()] = sess
+		}
+		l.mux.Unlock()
+
+		sess.deliver(pkt)
+
+		if !ok {
+			l.log.V(4).Info("new UDP session", "client", addr.String())
+			select {
+			case l.acceptCh <- sess:
+			case <-l.closeCh:
+				return
+			}
+		}
+	}
+}
+
+// Accept implements [net.Listener]. It blocks until a datagram from a client without an active session is received.
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case sess := <-l.acceptCh:
+		return sess, nil
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements [net.Listener]. It closes the underlying socket and all active sessions. Sessions can't be drained
+// like TCP connections since they receive their datagrams through the socket, which must be closed so that the
+// address can be bound again, e.g. by a frontend replacing this one.
+func (l *udpListener) Close() error {
+	err := l.conn.Close()
+	l.shutdown()
+	return err
+}
+
+// Addr implements [net.Listener].
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) shutdown() {
+	l.once.Do(func() {
+		close(l.closeCh)
+	})
+	l.mux.Lock()
+	sessions := make([]*udpSession, 0, len(l.sessions))
+	for _, sess := range l.sessions {
+		sessions = append(sessions, sess)
+	}
+	l.mux.Unlock()
+	for _, sess := range sessions {
+		if err := sess.Close(); err != nil && !isClosedErr(err) {
+			l.log.Error(err, "failed closing UDP session", "client", sess.raddr.String())
+		}
+	}
+}
+
+func (l *udpListener) removeSession(sess *udpSession) {
+	l.mux.Lock()
+	if l.sessions[sess.raddr.String()] == sess {
+		delete(l.sessions, sess.raddr.String())
+	}
+	l.mux.Unlock()
+}
+
+// udpSession is the [net.Conn] representing the datagrams exchanged with a single client address.
+type udpSession struct {
+	l       *udpListener
+	raddr   *net.UDPAddr
+	packets chan []byte
+	closeCh chan struct{}
+	once    sync.Once
+	// readDeadline makes pending and future reads fail when it expires.
+	readDeadline deadline
+}
+
+func (s *udpSession) deliver(pkt []byte) {
+	select {
+	case s.packets <- pkt:
+	default:
+		s.l.log.V(5).Info("session queue full, dropping datagram", "client", s.raddr.String())
+	}
+}
+
+// Read returns the next datagram received from the client. Datagrams that don't fit into b are truncated.
+func (s *udpSession) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-s.packets:
+		return copy(b, pkt), nil
+	case <-s.closeCh:
+		return 0, io.EOF
+	case <-s.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends b as a single datagram to the client.
+func (s *udpSession) Write(b []byte) (int, error) {
+	select {
+	case <-s.closeCh:
+		return 0, net.ErrClosed
+	default:
+	}
+	n, err := s.l.conn.WriteToUDP(b, s.raddr)
+	if err != nil {
+		return n, &net.OpError{Op: "write", Net: "udp", Source: s.LocalAddr(), Addr: s.raddr, Err: err}
+	}
+	return n, nil
+}
+
+// Close ends the session. The next datagram received from the same client address starts a new session.
+func (s *udpSession) Close() error {
+	closed := false
+	s.once.Do(func() {
+		close(s.closeCh)
+		s.l.removeSession(s)
+		closed = true
+	})
+	if !closed {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.l.conn.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.raddr
+}
+
+// SetDeadline sets the read deadline. Writes never block.
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements [net.Conn].
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op because writes never block.
+func (*udpSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// deadline signals the expiry of a point in time by closing a channel, like the deadlines of [net.Pipe].
+type deadline struct {
+	mux     sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() deadline {
+	return deadline{expired: make(chan struct{})}
+}
+
+// set changes the deadline. The zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer has fired already, wait for it to close the channel.
+		<-d.expired
+	}
+	d.timer = nil
+
+	expired := isClosedChan(d.expired)
+	if t.IsZero() {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		ch := d.expired
+		d.timer = time.AfterFunc(dur, func() {
+			close(ch)
+		})
+		return
+	}
+	if !expired {
+		close(d.expired)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *deadline) wait() <-chan struct{} {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.expired
+}
+
+func isClosedChan(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
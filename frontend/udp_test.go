@@ -0,0 +1,204 @@
+package frontend_test
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/frontend"
+)
+
+func startUDPEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err, "could not start backend listener")
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := srv.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if _, err := srv.WriteToUDP(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return srv
+}
+
+func TestUDPFrontendRoutesRepliesToClients(t *testing.T) {
+	t.Parallel()
+
+	srv := startUDPEchoServer(t)
+
+	fe, err := frontend.NewFrontend(frontend.ProtocolUDP, "127.0.0.1:0", logr.Discard(),
+		frontend.WithTimeout(time.Second))
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.LocalAddr().String(), 1))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	feAddr, ok := fe.Addr().(*net.UDPAddr)
+	require.True(t, ok, "frontend should listen on a UDP address")
+	clients := make([]*net.UDPConn, 0, 2)
+	for range 2 {
+		c, err := net.DialUDP("udp4", nil, feAddr)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, c.Close())
+		})
+		clients = append(clients, c)
+	}
+
+	large := make([]byte, 4096)
+	for idx := range large {
+		large[idx] = byte(idx)
+	}
+
+	for idx, c := range clients {
+		payload := append([]byte{byte(idx)}, large...)
+		_, err := c.Write(payload)
+		require.NoError(t, err)
+
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+		buf := make([]byte, 65535)
+		n, err := c.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, payload, buf[:n], "client %d received unexpected reply", idx)
+	}
+}
+
+func TestUDPSessionsAreNotDrained(t *testing.T) {
+	t.Parallel()
+
+	srv := startUDPEchoServer(t)
+
+	fe, err := frontend.NewFrontend(frontend.ProtocolUDP, "127.0.0.1:0", logr.Discard(),
+		frontend.WithDrainTimeout(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.LocalAddr().String(), 1))
+	require.NoError(t, fe.Start())
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	feAddr, ok := fe.Addr().(*net.UDPAddr)
+	require.True(t, ok, "frontend should listen on a UDP address")
+	c, err := net.DialUDP("udp4", nil, feAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = c.Read(make([]byte, 5))
+	require.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		fe.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		require.Fail(t, "stopping the frontend should have ended its UDP sessions without waiting for the drain timeout")
+	}
+}
+
+func TestUDPSessionsEndAfterIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := startUDPEchoServer(t)
+
+	fe, err := frontend.NewFrontend(frontend.ProtocolUDP, "127.0.0.1:0", logr.Discard(),
+		frontend.WithTimeout(200*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.LocalAddr().String(), 1))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	feAddr, ok := fe.Addr().(*net.UDPAddr)
+	require.True(t, ok, "frontend should listen on a UDP address")
+	c, err := net.DialUDP("udp4", nil, feAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+	exchange := func(msg string) {
+		t.Helper()
+		_, err := c.Write([]byte(msg))
+		require.NoError(t, err)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(buf[:n]))
+	}
+
+	exchange("hello")
+	require.Len(t, fe.Connections(), 1)
+	require.Eventually(t, func() bool { return len(fe.Connections()) == 0 }, 3*time.Second, 10*time.Millisecond,
+		"the session should have ended after the idle timeout")
+
+	// the next datagram from the same client starts a new session.
+	exchange("again")
+}
+
+func TestUDPClientsOnlyReceiveTheirOwnReplies(t *testing.T) {
+	t.Parallel()
+
+	srv := startUDPEchoServer(t)
+
+	fe, err := frontend.NewFrontend(frontend.ProtocolUDP, "127.0.0.1:0", logr.Discard(),
+		frontend.WithTimeout(time.Second))
+	require.NoError(t, err)
+	require.NoError(t, fe.AddBackend(srv.LocalAddr().String(), 1))
+	require.NoError(t, fe.Start())
+	t.Cleanup(fe.Stop)
+	require.Eventually(t, fe.Backends[0].IsHealthy, 3*time.Second, 10*time.Millisecond)
+
+	feAddr, ok := fe.Addr().(*net.UDPAddr)
+	require.True(t, ok, "frontend should listen on a UDP address")
+	clients := make([]*net.UDPConn, 0, 2)
+	for range 2 {
+		c, err := net.DialUDP("udp4", nil, feAddr)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, c.Close())
+		})
+		clients = append(clients, c)
+	}
+
+	// both clients send before reading so that replies routed to the wrong client would be noticed.
+	for round := range 3 {
+		for idx, c := range clients {
+			_, err := c.Write([]byte{byte(idx), byte(round)})
+			require.NoError(t, err)
+		}
+	}
+	for idx, c := range clients {
+		for round := range 3 {
+			require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			require.NoError(t, err)
+			require.Equal(t, []byte{byte(idx), byte(round)}, buf[:n], "client %d received unexpected reply", idx)
+		}
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		_, err := c.Read(make([]byte, 64))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded, "client %d received more replies than it sent datagrams", idx)
+	}
+}
@@ -0,0 +1,343 @@
+// Package metrics implements the Prometheus metrics exposed by the proxy. All methods are safe to call on nil
+// receivers so that metrics are optional for frontends and backends.
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "l4proxy"
+
+// Directions of proxied traffic, used as label values of the bytes transferred.
+const (
+	DirectionToBackend = "to_backend"
+	DirectionToClient  = "to_client"
+)
+
+// Reasons for rejecting client connections, used as label values of the rejected connections.
+const (
+	ReasonDenied             = "denied"
+	ReasonProxyProtocol      = "proxy_protocol"
+	ReasonNoHealthyBackend   = "no_healthy_backend"
+	ReasonBackendUnavailable = "backend_unavailable"
+	ReasonTLSClientHello     = "tls_client_hello"
+	ReasonTLSHandshake       = "tls_handshake"
+	ReasonNoRoute            = "no_route"
+	ReasonConnectionLimit    = "connection_limit"
+	ReasonSourceLimit        = "source_limit"
+	ReasonRateLimit          = "rate_limit"
+	ReasonBackendLimit       = "backend_limit"
+)
+
+// Metrics holds the collectors for all frontends and backends of the proxy.
+type Metrics struct {
+	connsAccepted       *prometheus.CounterVec
+	connsActive         *prometheus.GaugeVec
+	connsRejected       *prometheus.CounterVec
+	connDuration        *prometheus.HistogramVec
+	backendConnsActive  *prometheus.GaugeVec
+	dialErrors          *prometheus.CounterVec
+	backendHealthy      *prometheus.GaugeVec
+	healthCheckDuration *prometheus.HistogramVec
+	bytes               *prometheus.CounterVec
+	ejections           *prometheus.CounterVec
+}
+
+// New creates the proxy's collectors and registers them with reg.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		connsAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "frontend",
+			Name:      "connections_accepted_total",
+			Help:      "Number of client connections accepted by the frontend.",
+		}, []string{"frontend"}),
+		connsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "frontend",
+			Name:      "connections_active",
+			Help:      "Number of client connections currently handled by the frontend.",
+		}, []string{"frontend"}),
+		connsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "frontend",
+			Name:      "connections_rejected_total",
+			Help:      "Number of client connections closed by the frontend without proxying them, by reason.",
+		}, []string{"frontend", "reason"}),
+		connDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "frontend",
+			Name:      "connection_duration_seconds",
+			Help:      "Duration of client connections handled by the frontend.",
+			Buckets:   []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}, []string{"frontend"}),
+		backendConnsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "backend",
+			Name:      "connections_active",
+			Help:      "Number of connections currently proxied to the backend.",
+		}, []string{"frontend", "backend"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "backend",
+			Name:      "dial_errors_total",
+			Help:      "Number of failed attempts to connect to the backend for proxying a client connection.",
+		}, []string{"frontend", "backend"}),
+		backendHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "backend",
+			Name:      "healthy",
+			Help:      "Whether the backend is considered healthy (1) or not (0).",
+		}, []string{"frontend", "backend"}),
+		healthCheckDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "backend",
+			Name:      "health_check_duration_seconds",
+			Help:      "Duration of the backend's health checks.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"frontend", "backend"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "backend",
+			Name:      "transferred_bytes_total",
+			Help:      "Number of bytes proxied between clients and the backend, by direction.",
+		}, []string{"frontend", "backend", "direction"}),
+		ejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "backend",
+			Name:      "ejections_total",
+			Help:      "Number of times the backend has been ejected by outlier detection.",
+		}, []string{"frontend", "backend"}),
+	}
+
+	for _, c := range m.collectors() {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed registering collector: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.connsAccepted,
+		m.connsActive,
+		m.connsRejected,
+		m.connDuration,
+		m.backendConnsActive,
+		m.dialErrors,
+		m.backendHealthy,
+		m.healthCheckDuration,
+		m.bytes,
+		m.ejections,
+	}
+}
+
+// Frontend returns the metrics of the frontend with the given name.
+func (m *Metrics) Frontend(name string) *Frontend {
+	if m == nil {
+		return nil
+	}
+	return &Frontend{m: m, name: name}
+}
+
+// Frontend records the metrics of a single frontend.
+type Frontend struct {
+	m    *Metrics
+	name string
+	// deleted is set once the series have been deleted. Nothing is recorded afterwards so that connections still being
+	// drained neither recreate the series nor change the ones of a new frontend with the same name. It is guarded by
+	// mux, which is held while recording.
+	deleted bool
+	mux     sync.RWMutex
+}
+
+// record calls fn unless the frontend's series have been deleted.
+func (f *Frontend) record(fn func()) {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	if !f.deleted {
+		fn()
+	}
+}
+
+// Accepted records a newly accepted client connection. The returned function must be called when the connection has
+// been closed.
+func (f *Frontend) Accepted() func() {
+	if f == nil {
+		return func() {}
+	}
+	start := time.Now()
+	f.record(func() {
+		f.m.connsAccepted.WithLabelValues(f.name).Inc()
+		f.m.connsActive.WithLabelValues(f.name).Inc()
+	})
+	return func() {
+		f.record(func() {
+			f.m.connsActive.WithLabelValues(f.name).Dec()
+			f.m.connDuration.WithLabelValues(f.name).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// Rejected records a client connection that has been closed for the given reason without being proxied.
+func (f *Frontend) Rejected(reason string) {
+	if f == nil {
+		return
+	}
+	f.record(func() {
+		f.m.connsRejected.WithLabelValues(f.name, reason).Inc()
+	})
+}
+
+// Backend returns the metrics of the frontend's backend with the given address.
+func (f *Frontend) Backend(addr string) *Backend {
+	if f == nil {
+		return nil
+	}
+	return &Backend{m: f.m, fe: f, frontend: f.name, addr: addr}
+}
+
+// Delete removes all series of the frontend and its backends. Nothing is recorded for them afterwards.
+func (f *Frontend) Delete() {
+	if f == nil {
+		return
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.deleted {
+		return
+	}
+	f.deleted = true
+	for _, c := range f.m.collectors() {
+		if vec, ok := c.(interface {
+			DeletePartialMatch(labels prometheus.Labels) int
+		}); ok {
+			vec.DeletePartialMatch(prometheus.Labels{"frontend": f.name})
+		}
+	}
+}
+
+// Backend records the metrics of a single backend.
+type Backend struct {
+	m        *Metrics
+	fe       *Frontend
+	frontend string
+	addr     string
+	// deleted is set once the series have been deleted, see Frontend. It is guarded by mux.
+	deleted bool
+	mux     sync.RWMutex
+}
+
+// record calls fn unless the series of the backend or its frontend have been deleted.
+func (b *Backend) record(fn func()) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if !b.deleted {
+		b.fe.record(fn)
+	}
+}
+
+// ConnOpened records a connection being proxied to the backend. The returned function must be called when the
+// connection has been closed.
+func (b *Backend) ConnOpened() func() {
+	if b == nil {
+		return func() {}
+	}
+	b.record(func() {
+		b.m.backendConnsActive.WithLabelValues(b.frontend, b.addr).Inc()
+	})
+	return func() {
+		b.record(func() {
+			b.m.backendConnsActive.WithLabelValues(b.frontend, b.addr).Dec()
+		})
+	}
+}
+
+// DialError records a failed attempt to connect to the backend.
+func (b *Backend) DialError() {
+	if b == nil {
+		return
+	}
+	b.record(func() {
+		b.m.dialErrors.WithLabelValues(b.frontend, b.addr).Inc()
+	})
+}
+
+// SetHealthy records the backend's health state.
+func (b *Backend) SetHealthy(healthy bool) {
+	if b == nil {
+		return
+	}
+	var v float64
+	if healthy {
+		v = 1
+	}
+	b.record(func() {
+		b.m.backendHealthy.WithLabelValues(b.frontend, b.addr).Set(v)
+	})
+}
+
+// ObserveHealthCheck records the duration of a health check.
+func (b *Backend) ObserveHealthCheck(d time.Duration) {
+	if b == nil {
+		return
+	}
+	b.record(func() {
+		b.m.healthCheckDuration.WithLabelValues(b.frontend, b.addr).Observe(d.Seconds())
+	})
+}
+
+// Ejected records the backend being ejected by outlier detection.
+func (b *Backend) Ejected() {
+	if b == nil {
+		return
+	}
+	b.record(func() {
+		b.m.ejections.WithLabelValues(b.frontend, b.addr).Inc()
+	})
+}
+
+// Transferred returns the counter of bytes proxied in the given direction. It returns nil for a nil receiver and once
+// the backend's series have been deleted.
+func (b *Backend) Transferred(direction string) prometheus.Counter {
+	if b == nil {
+		return nil
+	}
+	var c prometheus.Counter
+	b.record(func() {
+		c = b.m.bytes.WithLabelValues(b.frontend, b.addr, direction)
+	})
+	return c
+}
+
+// Delete removes all series of the backend. Nothing is recorded for it afterwards. Series that have already been
+// deleted along with the frontend's are left alone since they might belong to a new frontend with the same name by now.
+func (b *Backend) Delete() {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.deleted {
+		return
+	}
+	b.deleted = true
+	b.fe.mux.RLock()
+	defer b.fe.mux.RUnlock()
+	if b.fe.deleted {
+		return
+	}
+	for _, c := range b.m.collectors() {
+		if vec, ok := c.(interface {
+			DeletePartialMatch(labels prometheus.Labels) int
+		}); ok {
+			vec.DeletePartialMatch(prometheus.Labels{"frontend": b.frontend, "backend": b.addr})
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHeader is returned when a PROXY protocol header can't be parsed.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+const (
+	v1Prefix = "PROXY "
+	// v1MaxLen is the maximum length of a version 1 header including the terminating CRLF.
+	v1MaxLen = 107
+
+	// v2FixedLen is the length of the signature, version/command, family and length fields of a version 2 header.
+	v2FixedLen = 16
+)
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version Version
+	// Src and Dst are the addresses of the original connection. They are nil when the header doesn't carry address
+	// information, e.g. for connections established by the proxy itself such as health checks.
+	Src net.Addr
+	Dst net.Addr
+}
+
+// ReadHeader reads a version 1 or version 2 PROXY protocol header from r. It never reads beyond the end of the header
+// so that the remaining data can be read from r afterwards. Errors caused by malformed headers wrap
+// [ErrInvalidHeader].
+func ReadHeader(r io.Reader) (Header, error) {
+	prefix := make([]byte, len(v1Prefix))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return Header{}, fmt.Errorf("failed reading PROXY protocol header: %w", err)
+	}
+	switch {
+	case string(prefix) == v1Prefix:
+		return readV1(r)
+	case bytes.Equal(prefix, v2Signature[:len(prefix)]):
+		return readV2(r, prefix)
+	default:
+		return Header{}, fmt.Errorf("%w: unknown signature", ErrInvalidHeader)
+	}
+}
+
+func readV1(r io.Reader) (Header, error) {
+	line := make([]byte, 0, v1MaxLen-len(v1Prefix))
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return Header{}, fmt.Errorf("%w: version 1 header exceeds %d bytes", ErrInvalidHeader, v1MaxLen)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return Header{}, fmt.Errorf("failed reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	hdr := Header{Version: V1}
+	if fields[0] == "UNKNOWN" {
+		return hdr, nil
+	}
+	if len(fields) != 5 {
+		return Header{}, fmt.Errorf("%w: unexpected number of fields in version 1 header", ErrInvalidHeader)
+	}
+
+	var is4 bool
+	switch fields[0] {
+	case "TCP4":
+		is4 = true
+	case "TCP6":
+	default:
+		return Header{}, fmt.Errorf("%w: unknown protocol %q", ErrInvalidHeader, fields[0])
+	}
+
+	src, err := parseV1AddrPort(fields[1], fields[3], is4)
+	if err != nil {
+		return Header{}, err
+	}
+	dst, err := parseV1AddrPort(fields[2], fields[4], is4)
+	if err != nil {
+		return Header{}, err
+	}
+	hdr.Src, hdr.Dst = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+
+	return hdr, nil
+}
+
+func parseV1AddrPort(addr, port string, is4 bool) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || ip.Zone() != "" || ip.Is4() != is4 {
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid address %q", ErrInvalidHeader, addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid port %q", ErrInvalidHeader, port)
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+func readV2(r io.Reader, prefix []byte) (Header, error) {
+	fixed := make([]byte, v2FixedLen)
+	copy(fixed, prefix)
+	if _, err := io.ReadFull(r, fixed[len(prefix):]); err != nil {
+		return Header{}, fmt.Errorf("failed reading PROXY protocol header: %w", err)
+	}
+	if !bytes.Equal(fixed[:len(v2Signature)], v2Signature) {
+		return Header{}, fmt.Errorf("%w: unknown signature", ErrInvalidHeader)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Header{}, fmt.Errorf("failed reading PROXY protocol header: %w", err)
+	}
+
+	hdr := Header{Version: V2}
+	switch fixed[12] {
+	case v2VersionLocal:
+		return hdr, nil
+	case v2VersionProxy:
+	default:
+		return Header{}, fmt.Errorf("%w: unsupported version/command 0x%02x", ErrInvalidHeader, fixed[12])
+	}
+
+	var addrLen int
+	family := fixed[13]
+	switch family {
+	case v2FamilyTCP4, v2FamilyUDP4:
+		addrLen = 4
+	case v2FamilyTCP6, v2FamilyUDP6:
+		addrLen = 16
+	default:
+		// unspecified or unsupported (e.g. UNIX sockets) address family, the addresses are to be ignored.
+		return hdr, nil
+	}
+	if len(payload) < 2*addrLen+4 {
+		return Header{}, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:addrLen])
+	dstIP, _ := netip.AddrFromSlice(payload[addrLen : 2*addrLen])
+	src := netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(payload[2*addrLen:]))
+	dst := netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(payload[2*addrLen+2:]))
+	if family == v2FamilyUDP4 || family == v2FamilyUDP6 {
+		hdr.Src, hdr.Dst = net.UDPAddrFromAddrPort(src), net.UDPAddrFromAddrPort(dst)
+	} else {
+		hdr.Src, hdr.Dst = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+	}
+
+	return hdr, nil
+}
+
+// Conn is a [net.Conn] reporting the addresses announced in a PROXY protocol header instead of the addresses of the
+// underlying connection.
+type Conn struct {
+	net.Conn
+	src net.Addr
+	dst net.Addr
+}
+
+// NewConn returns a connection reporting the addresses from hdr. If hdr doesn't carry address information, c is
+// returned unchanged.
+func NewConn(c net.Conn, hdr Header) net.Conn {
+	if hdr.Src == nil || hdr.Dst == nil {
+		return c
+	}
+	return &Conn{Conn: c, src: hdr.Src, dst: hdr.Dst}
+}
+
+// RemoteAddr returns the source address announced in the PROXY protocol header.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+// LocalAddr returns the destination address announced in the PROXY protocol header.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
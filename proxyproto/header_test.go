@@ -0,0 +1,112 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+func TestReadHeaderRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		version proxyproto.Version
+		src     net.Addr
+		dst     net.Addr
+	}{
+		{name: "v1 TCP4", version: proxyproto.V1, src: tcpAddr(t, "192.0.2.1:56324"), dst: tcpAddr(t, "198.51.100.2:443")},
+		{name: "v1 TCP6", version: proxyproto.V1, src: tcpAddr(t, "[2001:db8::1]:56324"), dst: tcpAddr(t, "[2001:db8::2]:443")},
+		{name: "v2 TCP4", version: proxyproto.V2, src: tcpAddr(t, "192.0.2.1:56324"), dst: tcpAddr(t, "198.51.100.2:443")},
+		{name: "v2 TCP6", version: proxyproto.V2, src: tcpAddr(t, "[2001:db8::1]:56324"), dst: tcpAddr(t, "[2001:db8::2]:443")},
+		{
+			name:    "v2 UDP4",
+			version: proxyproto.V2,
+			src:     &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53000},
+			dst:     &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 53},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			require.NoError(t, proxyproto.WriteHeader(&buf, tt.version, tt.src, tt.dst))
+			buf.WriteString("payload")
+
+			hdr, err := proxyproto.ReadHeader(&buf)
+			require.NoError(t, err)
+			require.Equal(t, tt.version, hdr.Version)
+			require.Equal(t, tt.src.String(), hdr.Src.String())
+			require.Equal(t, tt.dst.String(), hdr.Dst.String())
+			require.Equal(t, tt.src.Network(), hdr.Src.Network())
+
+			rest, err := io.ReadAll(&buf)
+			require.NoError(t, err)
+			require.Equal(t, "payload", string(rest), "data following the header must not be consumed")
+		})
+	}
+}
+
+func TestReadHeaderWithoutAddresses(t *testing.T) {
+	t.Parallel()
+
+	hdr, err := proxyproto.ReadHeader(strings.NewReader("PROXY UNKNOWN ignored stuff\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, proxyproto.V1, hdr.Version)
+	require.Nil(t, hdr.Src)
+
+	local := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A, 0x20, 0x00, 0x00, 0x00}
+	hdr, err = proxyproto.ReadHeader(bytes.NewReader(local))
+	require.NoError(t, err)
+	require.Equal(t, proxyproto.V2, hdr.Version)
+	require.Nil(t, hdr.Src)
+
+	c, _ := net.Pipe()
+	require.Same(t, c, proxyproto.NewConn(c, hdr))
+}
+
+func TestReadHeaderRejectsMalformedHeaders(t *testing.T) {
+	t.Parallel()
+
+	for name, input := range map[string]string{
+		"no header":         "GET / HTTP/1.1\r\n\r\n",
+		"wrong family":      "PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n",
+		"missing fields":    "PROXY TCP4 192.0.2.1 192.0.2.2 1\r\n",
+		"invalid port":      "PROXY TCP4 192.0.2.1 192.0.2.2 1 65536\r\n",
+		"unknown protocol":  "PROXY UDP4 192.0.2.1 192.0.2.2 1 2\r\n",
+		"unterminated":      "PROXY TCP4 192.0.2.1 192.0.2.2 1 2" + strings.Repeat(" ", 100),
+		"broken signature":  "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00",
+		"wrong v2 version":  "\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+		"short v2 addrs":    "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+		"truncated payload": "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0C\x01\x02",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := proxyproto.ReadHeader(strings.NewReader(input))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestConnReportsAnnouncedAddresses(t *testing.T) {
+	t.Parallel()
+
+	c, _ := net.Pipe()
+	hdr := proxyproto.Header{Version: proxyproto.V1, Src: tcpAddr(t, "192.0.2.1:1234"), Dst: tcpAddr(t, "192.0.2.2:443")}
+	wrapped := proxyproto.NewConn(c, hdr)
+	require.Equal(t, hdr.Src, wrapped.RemoteAddr())
+	require.Equal(t, hdr.Dst, wrapped.LocalAddr())
+
+	pc, ok := wrapped.(*proxyproto.Conn)
+	require.True(t, ok)
+	require.Same(t, c, pc.NetConn())
+}
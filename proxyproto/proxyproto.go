@@ -0,0 +1,183 @@
+// Package proxyproto implements version 1 and 2 of the PROXY protocol as specified in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+)
+
+// Version is a version of the PROXY protocol.
+type Version byte
+
+// Supported versions of the PROXY protocol. [None] means that the PROXY protocol is not used at all.
+const (
+	None Version = 0
+	V1   Version = 1
+	V2   Version = 2
+)
+
+// ParseVersion parses the textual representation of a PROXY protocol version, i.e. "v1" or "v2". An empty string
+// results in [None].
+func ParseVersion(s string) (Version, error) {
+	switch s {
+	case "":
+		return None, nil
+	case "v1":
+		return V1, nil
+	case "v2":
+		return V2, nil
+	default:
+		return None, fmt.Errorf("unknown PROXY protocol version %q, expected one of v1, v2", s)
+	}
+}
+
+// String returns the textual representation of the version as accepted by [ParseVersion].
+func (v Version) String() string {
+	switch v {
+	case None:
+		return ""
+	case V1:
+		return "v1"
+	case V2:
+		return "v2"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(v))
+	}
+}
+
+// MarshalText implements [encoding.TextMarshaler].
+func (v Version) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+// v2Signature is the fixed prefix of every version 2 header.
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	v2VersionProxy = 0x21
+	v2VersionLocal = 0x20
+
+	v2FamilyUnspec = 0x00
+	v2FamilyTCP4   = 0x11
+	v2FamilyUDP4   = 0x12
+	v2FamilyTCP6   = 0x21
+	v2FamilyUDP6   = 0x22
+)
+
+// WriteHeader writes a PROXY protocol header of the given version to w, announcing a connection from src to dst.
+// Headers for connections that can't be represented by the protocol, e.g. because the addresses aren't TCP or UDP
+// addresses, announce an unknown connection. Nothing is written for [None].
+func WriteHeader(w io.Writer, v Version, src, dst net.Addr) error {
+	var hdr []byte
+	switch v {
+	case None:
+		return nil
+	case V1:
+		hdr = v1Header(src, dst)
+	case V2:
+		hdr = v2Header(src, dst)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", v)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return fmt.Errorf("failed writing PROXY protocol header: %w", err)
+	}
+	return nil
+}
+
+// WriteLocalHeader writes a PROXY protocol header of the given version to w that announces a connection established
+// by the proxy itself, e.g. for a health check, instead of a proxied one. Version 2 headers use the LOCAL command and
+// version 1 headers announce an unknown connection. Nothing is written for [None].
+func WriteLocalHeader(w io.Writer, v Version) error {
+	var hdr []byte
+	switch v {
+	case None:
+		return nil
+	case V1:
+		hdr = []byte("PROXY UNKNOWN\r\n")
+	case V2:
+		hdr = append(append([]byte{}, v2Signature...), v2VersionLocal, v2FamilyUnspec, 0, 0)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", v)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return fmt.Errorf("failed writing PROXY protocol header: %w", err)
+	}
+	return nil
+}
+
+// addrPorts converts the source and destination addresses into address/port pairs of the same address family. IPv4
+// addresses are mapped into the IPv6 address space if the other address is an IPv6 address. It reports false if the
+// addresses aren't both TCP or both UDP addresses.
+func addrPorts(src, dst net.Addr) (srcAP, dstAP netip.AddrPort, udp, ok bool) {
+	switch s := src.(type) {
+	case *net.TCPAddr:
+		d, isTCP := dst.(*net.TCPAddr)
+		if !isTCP {
+			return srcAP, dstAP, false, false
+		}
+		srcAP, dstAP = s.AddrPort(), d.AddrPort()
+	case *net.UDPAddr:
+		d, isUDP := dst.(*net.UDPAddr)
+		if !isUDP {
+			return srcAP, dstAP, false, false
+		}
+		srcAP, dstAP, udp = s.AddrPort(), d.AddrPort(), true
+	default:
+		return srcAP, dstAP, false, false
+	}
+
+	srcAddr, dstAddr := srcAP.Addr().Unmap().WithZone(""), dstAP.Addr().Unmap().WithZone("")
+	if srcAddr.Is4() != dstAddr.Is4() {
+		srcAddr, dstAddr = netip.AddrFrom16(srcAddr.As16()), netip.AddrFrom16(dstAddr.As16())
+	}
+	return netip.AddrPortFrom(srcAddr, srcAP.Port()), netip.AddrPortFrom(dstAddr, dstAP.Port()), udp, true
+}
+
+func v1Header(src, dst net.Addr) []byte {
+	srcAP, dstAP, udp, ok := addrPorts(src, dst)
+	if !ok || udp {
+		// version 1 only supports TCP.
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if srcAP.Addr().Is6() {
+		proto = "TCP6"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, srcAP.Addr(), dstAP.Addr(), srcAP.Port(), dstAP.Port())
+}
+
+func v2Header(src, dst net.Addr) []byte {
+	hdr := make([]byte, 0, len(v2Signature)+4+36)
+	hdr = append(hdr, v2Signature...)
+	hdr = append(hdr, v2VersionProxy)
+
+	srcAP, dstAP, udp, ok := addrPorts(src, dst)
+	if !ok {
+		return append(hdr, v2FamilyUnspec, 0, 0)
+	}
+
+	var family byte
+	switch {
+	case srcAP.Addr().Is4() && udp:
+		family = v2FamilyUDP4
+	case srcAP.Addr().Is4():
+		family = v2FamilyTCP4
+	case udp:
+		family = v2FamilyUDP6
+	default:
+		family = v2FamilyTCP6
+	}
+	srcIP, dstIP := srcAP.Addr().AsSlice(), dstAP.Addr().AsSlice()
+
+	hdr = append(hdr, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(srcIP)+len(dstIP)+4)) //nolint:gosec // at most 36
+	hdr = append(hdr, srcIP...)
+	hdr = append(hdr, dstIP...)
+	hdr = binary.BigEndian.AppendUint16(hdr, srcAP.Port())
+	return binary.BigEndian.AppendUint16(hdr, dstAP.Port())
+}
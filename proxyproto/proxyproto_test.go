@@ -0,0 +1,129 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/makkes/l4proxy/proxyproto"
+)
+
+func TestParseVersion(t *testing.T) {
+	t.Parallel()
+
+	for s, expected := range map[string]proxyproto.Version{
+		"":   proxyproto.None,
+		"v1": proxyproto.V1,
+		"v2": proxyproto.V2,
+	} {
+		v, err := proxyproto.ParseVersion(s)
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+		require.Equal(t, s, v.String())
+	}
+
+	_, err := proxyproto.ParseVersion("v3")
+	require.Error(t, err)
+}
+
+func tcpAddr(t *testing.T, s string) *net.TCPAddr {
+	t.Helper()
+
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	require.NoError(t, err)
+	return addr
+}
+
+func TestWriteHeaderV1(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		src      net.Addr
+		dst      net.Addr
+		expected string
+	}{
+		{
+			name:     "TCP4",
+			src:      tcpAddr(t, "192.0.2.1:56324"),
+			dst:      tcpAddr(t, "198.51.100.2:443"),
+			expected: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n",
+		},
+		{
+			name:     "TCP6",
+			src:      tcpAddr(t, "[2001:db8::1]:56324"),
+			dst:      tcpAddr(t, "[2001:db8::2]:443"),
+			expected: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:     "mixed families",
+			src:      tcpAddr(t, "192.0.2.1:56324"),
+			dst:      tcpAddr(t, "[2001:db8::2]:443"),
+			expected: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:     "UDP",
+			src:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53},
+			dst:      &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 53},
+			expected: "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			require.NoError(t, proxyproto.WriteHeader(&buf, proxyproto.V1, tt.src, tt.dst))
+			require.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestWriteHeaderV2(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, proxyproto.WriteHeader(&buf, proxyproto.V2, tcpAddr(t, "192.0.2.1:56324"), tcpAddr(t, "198.51.100.2:443")))
+	require.Equal(t, []byte{
+		0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A, // signature
+		0x21,       // version 2, PROXY command
+		0x11,       // TCP over IPv4
+		0x00, 0x0C, // length
+		192, 0, 2, 1, // source address
+		198, 51, 100, 2, // destination address
+		0xDC, 0x04, // source port
+		0x01, 0xBB, // destination port
+	}, buf.Bytes())
+}
+
+func TestWriteLocalHeader(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, proxyproto.WriteLocalHeader(&buf, proxyproto.V1))
+	require.Equal(t, "PROXY UNKNOWN\r\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, proxyproto.WriteLocalHeader(&buf, proxyproto.V2))
+	require.Equal(t, []byte{
+		0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A, // signature
+		0x20,       // version 2, LOCAL command
+		0x00,       // unspecified address family
+		0x00, 0x00, // length
+	}, buf.Bytes())
+
+	buf.Reset()
+	require.NoError(t, proxyproto.WriteLocalHeader(&buf, proxyproto.None))
+	require.Zero(t, buf.Len())
+}
+
+func TestWriteHeaderNoneWritesNothing(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, proxyproto.WriteHeader(&buf, proxyproto.None, tcpAddr(t, "192.0.2.1:1"), tcpAddr(t, "192.0.2.2:2")))
+	require.Zero(t, buf.Len())
+}